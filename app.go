@@ -3,58 +3,218 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
-	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router      *mux.Router
+	DB          *sql.DB
+	Store       Store
+	config      *config
+	events      *hub
+	broadcaster broadcaster
+	rooms       *roomsView
 }
 
 func (a *App) Initialize(user string, password string, dbname string) {
-	connectionString :=
-		fmt.Sprintf("postgres://%s:%s@localhost/%s?sslmode=disable", user, password, dbname)
+	c := defaultConfig()
+	c.DB.User = user
+	c.DB.Password = password
+	c.DB.Name = dbname
 
-	var err error
-	a.DB, err = sql.Open("postgres", connectionString)
-	if err != nil {
+	if err := a.Configure(c); err != nil {
 		log.Fatal(err)
 	}
+}
+
+func (a *App) Configure(c *config) error {
+	store, err := a.openStore(c)
+	if err != nil {
+		return err
+	}
+
+	a.config = c
+	a.InitializeStore(store)
+
+	if c.Store == "postgres" && c.DB.Notify {
+		n, err := newPgNotifier(c.dsn(), store, a.events)
+		if err != nil {
+			store.Close()
+			return err
+		}
+		a.broadcaster = n
+		// The rooms were loaded before listening, the changes in between
+		// are only seen by reading them again.
+		a.events.publish(change{Op: "resync"})
+	}
+
+	return nil
+}
+
+func (a *App) openStore(c *config) (Store, error) {
+	if c.Store == "memory" {
+		return newMemoryStore(c.DB.Path)
+	}
+
+	driver := map[string]string{"postgres": "postgres", "mssql": "sqlserver", "sqlite": "sqlite3"}[c.Store]
+	dsn := c.dsn()
+	if c.Store == "sqlite" {
+		dsn = sqliteDSN(dsn)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(c.DB.MaxOpenConns)
+	// Zero idle connections would close every connection after use, and an
+	// in-memory SQLite database with it, zero keeps the driver default.
+	if c.DB.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.DB.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(c.DB.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.DB.ConnMaxIdleTime)
+
+	var store Store
+	switch c.Store {
+	case "mssql":
+		store, err = newMSSQLStore(db)
+	case "sqlite":
+		store, err = newSQLiteStore(db)
+	default:
+		a.DB = db
+		store, err = newPostgresStore(db, c.DB.Notify)
+	}
+	if err == nil && c.Store != "mssql" {
+		q := postgresUsers
+		if c.Store == "sqlite" {
+			q = sqliteUsers
+		} else if c.DB.Notify {
+			q.history = postgresNotifyHistory
+		}
+		if c.DB.UsersTable {
+			store, err = newUsersStore(store, db, q)
+		} else {
+			err = restoreUsers(db, q)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (a *App) InitializeStore(store Store) {
+	if a.config == nil {
+		a.config = defaultConfig()
+	}
 
+	a.Store = store
+	a.events = newHub()
+	a.broadcaster = a.events
+	// Without notifications the writes of other instances never reach the
+	// hub, the rooms are then read from the store.
+	if a.config.Store != "postgres" || a.config.DB.Notify {
+		a.rooms = newRoomsView(store, a.events)
+	}
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 }
 
+// handler wraps the router with the CORS headers of the configured
+// origins, the handlers leave them out.
+func (a *App) handler() http.Handler {
+	headersOk := handlers.AllowedHeaders(a.config.CORS.Headers)
+	originsOk := handlers.AllowedOrigins(a.config.CORS.Origins)
+	methodsOk := handlers.AllowedMethods([]string{"GET", "DELETE", "POST", "PUT", "PATCH", "OPTIONS"})
+	exposedOk := handlers.ExposedHeaders([]string{"ETag", "Last-Modified"})
+
+	return handlers.CORS(originsOk, headersOk, methodsOk, exposedOk)(a.Router)
+}
+
 func (a *App) Run(addr string) {
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Content-Length", "Accept-Encoding"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "DELETE", "POST", "PUT", "OPTIONS"})
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      a.handler(),
+		ReadTimeout:  a.config.HTTP.ReadTimeout,
+		WriteTimeout: a.config.HTTP.WriteTimeout,
+		IdleTimeout:  a.config.HTTP.IdleTimeout,
+	}
 
-	log.Fatal(http.ListenAndServe(":8880", handlers.CORS(originsOk, headersOk, methodsOk)(a.Router)))
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), a.config.HTTP.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	stop := make(chan struct{})
+	if a.config.Presence.TTL > 0 {
+		go a.sweepPresence(stop)
+	}
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	close(stop)
+
+	if n, ok := a.broadcaster.(*pgNotifier); ok {
+		n.Close()
+	}
+
+	if err := a.Store.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func (a *App) initializeRoutes() {
 	a.Router.HandleFunc("/states", a.getStates).Methods("GET")
+	// Routes under a reserved _ prefix never shadow a state id or key.
+	a.Router.HandleFunc("/_ws", a.subscribeWS).Methods("GET")
+	a.Router.HandleFunc("/_search", a.findState).Methods("GET", "POST")
+	a.Router.HandleFunc("/_events/{tag}", a.streamEvents).Methods("GET")
+	a.Router.HandleFunc("/_events/{tag}/{id}", a.streamEvents).Methods("GET")
+	a.Router.HandleFunc("/_history/{tag}/{id}", a.getStateHistory).Methods("GET")
+	a.Router.HandleFunc("/_query/{tag}", a.queryTag).Methods("GET")
+	a.Router.HandleFunc("/_query/{tag}/{id}", a.queryState).Methods("GET")
 	a.Router.HandleFunc("/galaxy/rooms", a.getRooms).Methods("GET")
 	a.Router.HandleFunc("/galaxy/room/{id}", a.getRoom).Methods("GET")
+	a.Router.HandleFunc("/galaxy/users/{user}/heartbeat", a.heartbeat).Methods("POST")
 	a.Router.HandleFunc("/{tag}", a.getStateByTag).Methods("GET")
+	a.Router.HandleFunc("/{tag}/{id}", a.getStatePath).Methods("GET").Queries("path", "{path}")
 	a.Router.HandleFunc("/{tag}/{id}", a.getState).Methods("GET")
-	a.Router.HandleFunc("/{tag}/{id}/{jsonb}", a.getStateJSON).Methods("GET")
+	a.Router.HandleFunc("/{tag}/{id}/{path:.+}", a.getStatePath).Methods("GET")
+	a.Router.HandleFunc("/{tag}/{id}", a.postStatePath).Methods("PUT").Queries("path", "{path}")
 	a.Router.HandleFunc("/{tag}/{id}", a.postState).Methods("PUT")
 	a.Router.HandleFunc("/{tag}/{id}", a.updateState).Methods("POST")
 	a.Router.HandleFunc("/{tag}/{id}/{jsonb}", a.postStateJSON).Methods("PUT")
+	a.Router.HandleFunc("/{tag}/{id}/{path:.+}", a.postStatePath).Methods("PUT")
 	a.Router.HandleFunc("/{tag}/{id}/{jsonb}", a.postStateValue).Methods("POST")
+	a.Router.HandleFunc("/{tag}/{id}/{path:.+}/incr", a.incrStatePath).Methods("POST")
+	a.Router.HandleFunc("/{tag}/{id}/{path:.+}/decr", a.incrStatePath).Methods("POST")
+	a.Router.HandleFunc("/{tag}/{id}/{path:.+}/{op:append|prepend|add|remove}", a.arrayStatePath).Methods("POST")
+	a.Router.HandleFunc("/{tag}/{id}", a.patchState).Methods("PATCH")
+	a.Router.HandleFunc("/{tag}/{id}", a.deleteStatePath).Methods("DELETE").Queries("path", "{path}")
 	a.Router.HandleFunc("/{tag}/{id}", a.deleteState).Methods("DELETE")
 	a.Router.HandleFunc("/{tag}/{id}/{jsonb}", a.deleteStateJSON).Methods("DELETE")
+	a.Router.HandleFunc("/{tag}/{id}/{path:.+}", a.deleteStatePath).Methods("DELETE")
 }
 
 func respondWithError(w http.ResponseWriter, code int, message string) {
@@ -65,7 +225,6 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	response, _ := json.Marshal(payload)
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(code)
 	w.Write(response)
 }
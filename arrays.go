@@ -0,0 +1,220 @@
+// arrays.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var errNotArray = errors.New("Value is not an array")
+
+// arrayOp is an operation on the array at a path. append, prepend and add,
+// which skips values already present, create a missing array. removeIndex
+// takes out the element at Index, removeValue the elements equal to Value
+// and removeMatch the elements containing Value.
+type arrayOp struct {
+	Op    string
+	Value interface{}
+	Index int
+}
+
+// arrayOpRequest is the body of a remove request, one of the fields is set.
+type arrayOpRequest struct {
+	Index *int             `json:"index"`
+	Value *json.RawMessage `json:"value"`
+	Match *json.RawMessage `json:"match"`
+}
+
+func parseArrayOp(op string, body []byte) (arrayOp, error) {
+	a := arrayOp{Op: op}
+	invalid := errors.New("Invalid resquest payload")
+
+	if op != "remove" {
+		if err := json.Unmarshal(body, &a.Value); err != nil {
+			return a, invalid
+		}
+		return a, nil
+	}
+
+	var req arrayOpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return a, invalid
+	}
+
+	switch {
+	case req.Index != nil && req.Value == nil && req.Match == nil:
+		if *req.Index < 0 {
+			return a, invalid
+		}
+		a.Op = "removeIndex"
+		a.Index = *req.Index
+	case req.Index == nil && req.Value != nil && req.Match == nil:
+		a.Op = "removeValue"
+		json.Unmarshal(*req.Value, &a.Value)
+	case req.Index == nil && req.Value == nil && req.Match != nil:
+		a.Op = "removeMatch"
+		json.Unmarshal(*req.Match, &a.Value)
+	default:
+		return a, errors.New("One of index, value or match is required")
+	}
+
+	return a, nil
+}
+
+// applyArrayOp runs op on the array at path and returns the new array.
+func applyArrayOp(data map[string]interface{}, path []string, op arrayOp) (map[string]interface{}, []interface{}, error) {
+	var arr []interface{}
+	v, err := pointerGet(data, path)
+	switch {
+	case err != nil && strings.HasPrefix(op.Op, "remove"):
+		return nil, nil, errPathNotFound
+	case err != nil:
+		arr = []interface{}{}
+	default:
+		a, ok := v.([]interface{})
+		if !ok {
+			return nil, nil, errNotArray
+		}
+		arr = a
+	}
+
+	switch op.Op {
+	case "append":
+		arr = append(arr, op.Value)
+	case "prepend":
+		arr = append([]interface{}{op.Value}, arr...)
+	case "add":
+		found := false
+		for _, e := range arr {
+			if reflect.DeepEqual(e, op.Value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			arr = append(arr, op.Value)
+		}
+	case "removeIndex":
+		if op.Index >= len(arr) {
+			return nil, nil, errPathNotFound
+		}
+		arr = append(arr[:op.Index:op.Index], arr[op.Index+1:]...)
+	case "removeValue", "removeMatch":
+		kept := []interface{}{}
+		for _, e := range arr {
+			if op.Op == "removeMatch" && jsonContains(e, op.Value) || op.Op == "removeValue" && reflect.DeepEqual(e, op.Value) {
+				continue
+			}
+			kept = append(kept, e)
+		}
+		arr = kept
+	}
+
+	data, err = pathSet(data, path, arr)
+
+	return data, arr, err
+}
+
+// jsonContains reports whether a contains b like the jsonb @> operator:
+// objects contain the members of b, arrays contain every element of b and,
+// at the top level only, a scalar b that is one of their elements.
+func jsonContains(a, b interface{}) bool {
+	at, ok := a.([]interface{})
+	switch b.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		if ok {
+			for _, e := range at {
+				if reflect.DeepEqual(e, b) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return containsJSON(a, b)
+}
+
+func containsJSON(a, b interface{}) bool {
+	switch bt := b.(type) {
+	case map[string]interface{}:
+		at, ok := a.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, bv := range bt {
+			av, ok := at[k]
+			if !ok || !containsJSON(av, bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		at, ok := a.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, bv := range bt {
+			found := false
+			for _, av := range at {
+				if containsJSON(av, bv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// arrayStatePath runs the array operation named by the last URL segment on
+// the array at a path and returns the new array.
+func (a *App) arrayStatePath(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path, err := requestPath(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+		return
+	}
+	op, err := parseArrayOp(vars["op"], body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	arr, err := a.Store.ArrayStatePath(&s, "arrayStatePath", path, op)
+	if err != nil {
+		respondWithWriteError(w, err)
+		return
+	}
+
+	a.notify(r, s.Rev, "arrayStatePath", pathKey(path), arr)
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, arr)
+}
@@ -0,0 +1,79 @@
+// arrays_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestArrayStatePath(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/galaxy/qa", `{"questions":[{"user":"a","text":"x"}],"name":"qa","rooms":{},"tags":[["x","y"],["z"]]}`, nil)
+
+	tests := []struct {
+		url, body string
+		code      int
+		want      string
+	}{
+		{"/galaxy/qa/questions/append", `{"user":"b","text":"y"}`, http.StatusOK, `[{"text":"x","user":"a"},{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/prepend", `1`, http.StatusOK, `[1,{"text":"x","user":"a"},{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/add", `1`, http.StatusOK, `[1,{"text":"x","user":"a"},{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/remove", `{"match":{"user":"a"}}`, http.StatusOK, `[1,{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/remove", `{"value":1}`, http.StatusOK, `[{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/remove", `{"index":0}`, http.StatusOK, `[]`},
+		{"/galaxy/qa/questions/remove", `{"index":0}`, http.StatusNotFound, ``},
+		{"/galaxy/qa/rooms/janus/add", `"gxy1"`, http.StatusOK, `["gxy1"]`},
+		{"/galaxy/qa/rooms/janus/add", `"gxy1"`, http.StatusOK, `["gxy1"]`},
+		{"/galaxy/qa/rooms/r2/janus/remove", `{"value":"gxy1"}`, http.StatusNotFound, ``},
+		{"/galaxy/qa/rooms/r2/x/janus/append", `1`, http.StatusNotFound, ``},
+		{"/galaxy/qa/name/append", `1`, http.StatusConflict, ``},
+		{"/galaxy/qa/questions/remove", `{"index":0,"value":1}`, http.StatusBadRequest, ``},
+		{"/galaxy/qa/questions/append", ``, http.StatusBadRequest, ``},
+		{"/galaxy/qa/tags/remove", `{"match":"x"}`, http.StatusOK, `[["z"]]`},
+		{"/galaxy/qa/tags/-/append", `"w"`, http.StatusOK, `["w"]`},
+		{"/galaxy/qa/tags/0/append", `"v"`, http.StatusOK, `["z","v"]`},
+		{"/galaxy/qa/tags/5/append", `"v"`, http.StatusNotFound, ``},
+		{"/galaxy/qa/tags/-1/append", `"v"`, http.StatusNotFound, ``},
+		{"/galaxy/qa/tags/-1/remove", `{"index":0}`, http.StatusNotFound, ``},
+	}
+
+	for _, tt := range tests {
+		rr := executeTestRequest(a, "POST", tt.url, tt.body, nil)
+		if rr.Code != tt.code {
+			t.Errorf("POST %s %s: expected %d. Got %d %s", tt.url, tt.body, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.want != "" && rr.Body.String() != tt.want {
+			t.Errorf("POST %s %s: expected %s. Got %s", tt.url, tt.body, tt.want, rr.Body.String())
+		}
+	}
+}
+
+func TestJSONContains(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{`{"a":1,"b":{"c":2,"d":3}}`, `{"b":{"c":2}}`, true},
+		{`{"a":1}`, `{"a":2}`, false},
+		{`[1,2,[3]]`, `[[3],1]`, true},
+		{`[1,2]`, `[3]`, false},
+		{`"a"`, `"a"`, true},
+		{`{"a":[1,2]}`, `{"a":1}`, false},
+		{`["a","b"]`, `"a"`, true},
+		{`["a","b"]`, `"c"`, false},
+		{`"a"`, `["a"]`, false},
+	}
+
+	for _, tt := range tests {
+		var a, b interface{}
+		json.Unmarshal([]byte(tt.a), &a)
+		json.Unmarshal([]byte(tt.b), &b)
+		if got := jsonContains(a, b); got != tt.want {
+			t.Errorf("%s @> %s: expected %v. Got %v", tt.a, tt.b, tt.want, got)
+		}
+	}
+}
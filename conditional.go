@@ -0,0 +1,168 @@
+// conditional.go
+
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidETag = errors.New("Invalid entity tag")
+
+// etag is the strong entity tag of a state revision.
+func etag(rev int) string {
+	return strconv.Quote(strconv.Itoa(rev))
+}
+
+func setETag(w http.ResponseWriter, rev int) {
+	if rev > 0 {
+		w.Header().Set("ETag", etag(rev))
+	}
+}
+
+// respondConditional sends payload as JSON unless the client's copy, told
+// by If-None-Match or If-Modified-Since, is still current. An empty tag is
+// replaced by a hash of the response body, a zero modified time sends no
+// Last-Modified.
+func respondConditional(w http.ResponseWriter, r *http.Request, tag string, modified time.Time, payload interface{}) {
+	response, _ := json.Marshal(payload)
+
+	if tag == "" {
+		sum := sha1.Sum(response)
+		tag = strconv.Quote(hex.EncodeToString(sum[:]))
+	}
+	modified = modified.Truncate(time.Second)
+
+	w.Header().Set("ETag", tag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(r, tag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// notModified evaluates If-None-Match with weak comparison or, only when it
+// is absent, If-Modified-Since.
+func notModified(r *http.Request, tag string, modified time.Time) bool {
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		if strings.TrimSpace(h) == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		for _, t := range strings.Split(h, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(t), "W/") == tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if h := r.Header.Get("If-Modified-Since"); h != "" && !modified.IsZero() {
+		since, err := http.ParseTime(h)
+		return err == nil && !modified.After(since)
+	}
+
+	return false
+}
+
+// preconditions parses the If-Match and If-None-Match headers of a write.
+func preconditions(r *http.Request) (*precondition, error) {
+	match := r.Header.Get("If-Match")
+	noneMatch := r.Header.Get("If-None-Match")
+	if match == "" && noneMatch == "" {
+		return nil, nil
+	}
+
+	p := &precondition{}
+	var err error
+	if match != "" {
+		if p.Match, p.MatchAny, err = parseETags(match, false); err != nil {
+			return nil, err
+		}
+	}
+	if noneMatch != "" {
+		if p.NoneMatch, p.NoneMatchAny, err = parseETags(noneMatch, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// parseETags returns the revisions of an entity tag list or whether it is
+// "*". Tags that can never match, like foreign or, without weak comparison,
+// weak ones, become revision -1.
+func parseETags(h string, weak bool) ([]int, bool, error) {
+	if strings.TrimSpace(h) == "*" {
+		return nil, true, nil
+	}
+
+	revs := []int{}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		isWeak := strings.HasPrefix(t, "W/")
+		t = strings.TrimPrefix(t, "W/")
+		if len(t) < 2 || t[0] != '"' || t[len(t)-1] != '"' {
+			return nil, false, errInvalidETag
+		}
+
+		rev, err := strconv.Atoi(t[1 : len(t)-1])
+		if err != nil || (isWeak && !weak) {
+			rev = -1
+		}
+		revs = append(revs, rev)
+	}
+
+	if len(revs) == 0 {
+		return nil, false, errInvalidETag
+	}
+
+	return revs, false, nil
+}
+
+// prepareWrite fills in the writer identity and the preconditions of a
+// write request.
+func prepareWrite(r *http.Request, s *state) error {
+	s.Client = clientID(r)
+
+	cond, err := preconditions(r)
+	if err != nil {
+		return err
+	}
+	s.Cond = cond
+
+	return nil
+}
+
+func respondWithWriteError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errPreconditionFailed:
+		respondWithError(w, http.StatusPreconditionFailed, err.Error())
+	case err == errInvalidKey, errors.Is(err, errInvalidPatch):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case err == sql.ErrNoRows, err == errPathNotFound:
+		respondWithError(w, http.StatusNotFound, "Not Found")
+	case errors.Is(err, errPatchConflict), err == errNotNumber, err == errNotArray:
+		respondWithError(w, http.StatusConflict, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
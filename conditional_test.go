@@ -0,0 +1,118 @@
+// conditional_test.go
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	a := newTestApp(t)
+
+	rr := executeTestRequest(a, "PUT", "/galaxy/room", `{"a":1}`, map[string]string{"If-None-Match": "*"})
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected the state to be created with ETag \"1\". Got %d '%v'", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	rr = executeTestRequest(a, "PUT", "/galaxy/room", `{"a":2}`, map[string]string{"If-None-Match": "*"})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 when creating an existing state. Got %d", rr.Code)
+	}
+
+	rr = executeTestRequest(a, "POST", "/galaxy/room", `{"a":3}`, map[string]string{"If-Match": `"1"`})
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"2"` {
+		t.Errorf("Expected the update to succeed with ETag \"2\". Got %d '%v'", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	for _, h := range []string{`"1"`, `W/"2"`, `"abc"`} {
+		rr = executeTestRequest(a, "POST", "/galaxy/room", `{"a":4}`, map[string]string{"If-Match": h})
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected 412 for If-Match %s. Got %d", h, rr.Code)
+		}
+	}
+
+	rr = executeTestRequest(a, "DELETE", "/galaxy/room/a", "", map[string]string{"If-Match": `"0", "2"`})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the key delete to succeed. Got %d", rr.Code)
+	}
+
+	rr = executeTestRequest(a, "DELETE", "/galaxy/room", "", map[string]string{"If-Match": "2"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unquoted entity tag. Got %d", rr.Code)
+	}
+
+	rr = executeTestRequest(a, "PUT", "/galaxy/missing/key", `{}`, map[string]string{"If-Match": "*"})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a missing state. Got %d", rr.Code)
+	}
+
+	rr = executeTestRequest(a, "GET", "/galaxy/room", "", nil)
+	if rr.Header().Get("ETag") != `"3"` {
+		t.Errorf("Expected ETag \"3\". Got '%v'", rr.Header().Get("ETag"))
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/test/one", `{"a":1}`, nil)
+
+	rr := executeTestRequest(a, "GET", "/test/one", "", nil)
+	modified := rr.Header().Get("Last-Modified")
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"1"` || modified == "" {
+		t.Fatalf("Expected ETag \"1\" and Last-Modified. Got %d '%v' '%v'", rr.Code, rr.Header().Get("ETag"), modified)
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one", "", map[string]string{"If-None-Match": `W/"1"`})
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("Expected 304 without body for a matching ETag. Got %d '%s'", rr.Code, rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one", "", map[string]string{"If-Modified-Since": modified})
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since. Got %d", rr.Code)
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	rr = executeTestRequest(a, "GET", "/test/one", "", map[string]string{"If-None-Match": `"0"`, "If-Modified-Since": modified})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale ETag. Got %d", rr.Code)
+	}
+
+	for i, url := range []string{"/test", "/states"} {
+		rr = executeTestRequest(a, "GET", url, "", nil)
+		tag := rr.Header().Get("ETag")
+		if rr.Code != http.StatusOK || tag == "" {
+			t.Fatalf("Expected an ETag for %s. Got %d '%v'", url, rr.Code, tag)
+		}
+
+		rr = executeTestRequest(a, "GET", url, "", map[string]string{"If-None-Match": tag})
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("Expected 304 for %s. Got %d", url, rr.Code)
+		}
+
+		executeTestRequest(a, "PUT", "/test/one/b", fmt.Sprintf(`{"n":%d}`, i), nil)
+
+		rr = executeTestRequest(a, "GET", url, "", map[string]string{"If-None-Match": tag})
+		if rr.Code != http.StatusOK || rr.Header().Get("ETag") == tag {
+			t.Errorf("Expected a new ETag for %s after a write. Got %d '%v'", url, rr.Code, rr.Header().Get("ETag"))
+		}
+	}
+
+	// The collections send no Last-Modified, a deletion does not move it.
+	executeTestRequest(a, "PUT", "/test/two", `{"a":1}`, nil)
+	for _, url := range []string{"/test", "/states"} {
+		rr = executeTestRequest(a, "GET", url, "", nil)
+		if rr.Header().Get("Last-Modified") != "" {
+			t.Errorf("Expected no Last-Modified for %s. Got '%v'", url, rr.Header().Get("Last-Modified"))
+		}
+	}
+	executeTestRequest(a, "DELETE", "/test/two", "", nil)
+	rr = executeTestRequest(a, "GET", "/states", "", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for /states after a deletion. Got %d", rr.Code)
+	}
+}
@@ -0,0 +1,324 @@
+// config.go
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type dbConfig struct {
+	DSN             string        `yaml:"dsn"`
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Name            string        `yaml:"name"`
+	SSLMode         string        `yaml:"sslmode"`
+	Path            string        `yaml:"path"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`
+	Notify          bool          `yaml:"notify"`
+	UsersTable      bool          `yaml:"users_table"`
+}
+
+type corsConfig struct {
+	Origins []string `yaml:"origins"`
+	Headers []string `yaml:"headers"`
+}
+
+type httpConfig struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// presenceConfig sets when the galaxy users expire without a heartbeat.
+type presenceConfig struct {
+	TTL   time.Duration `yaml:"ttl"`
+	Sweep time.Duration `yaml:"sweep"`
+}
+
+type config struct {
+	Store    string         `yaml:"store"`
+	Listen   string         `yaml:"listen"`
+	DB       dbConfig       `yaml:"db"`
+	CORS     corsConfig     `yaml:"cors"`
+	HTTP     httpConfig     `yaml:"http"`
+	Presence presenceConfig `yaml:"presence"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Store:  "postgres",
+		Listen: ":8880",
+		DB: dbConfig{
+			Host:    "localhost",
+			SSLMode: "disable",
+			Notify:  true,
+		},
+		CORS: corsConfig{
+			Origins: []string{"*"},
+			Headers: []string{"X-Requested-With", "Content-Type", "Content-Length", "Accept-Encoding", "X-Client-ID", "If-Match", "If-None-Match", "If-Modified-Since"},
+		},
+		HTTP: httpConfig{
+			ReadTimeout:     30 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// setting binds a configuration field to its flag and environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	ptr   interface{}
+}
+
+func (c *config) settings() []setting {
+	return []setting{
+		{"store", "APP_STORE", "storage backend: postgres, mssql, sqlite or memory", &c.Store},
+		{"listen", "APP_LISTEN", "HTTP listen address", &c.Listen},
+		{"db-dsn", "APP_DB_DSN", "full database DSN, overrides the other db settings", &c.DB.DSN},
+		{"db-host", "APP_DB_HOST", "database host", &c.DB.Host},
+		{"db-port", "APP_DB_PORT", "database port", &c.DB.Port},
+		{"db-user", "APP_DB_USERNAME", "database user", &c.DB.User},
+		{"db-password", "APP_DB_PASSWORD", "database password", &c.DB.Password},
+		{"db-name", "APP_DB_NAME", "database name", &c.DB.Name},
+		{"db-sslmode", "APP_DB_SSLMODE", "postgres sslmode", &c.DB.SSLMode},
+		{"db-path", "APP_DB_PATH", "sqlite file or memory snapshot file", &c.DB.Path},
+		{"db-max-open", "APP_DB_MAX_OPEN_CONNS", "maximum open database connections", &c.DB.MaxOpenConns},
+		{"db-max-idle", "APP_DB_MAX_IDLE_CONNS", "maximum idle database connections, 0 keeps the driver default", &c.DB.MaxIdleConns},
+		{"db-conn-lifetime", "APP_DB_CONN_MAX_LIFETIME", "maximum lifetime of a database connection", &c.DB.ConnMaxLifetime},
+		{"db-conn-idle-time", "APP_DB_CONN_MAX_IDLE_TIME", "maximum idle time of a database connection", &c.DB.ConnMaxIdleTime},
+		{"db-connect-timeout", "APP_DB_CONNECT_TIMEOUT", "database connect timeout", &c.DB.ConnectTimeout},
+		{"db-notify", "APP_DB_NOTIFY", "share changes between instances with postgres LISTEN/NOTIFY", &c.DB.Notify},
+		{"db-users-table", "APP_DB_USERS_TABLE", "store the galaxy users state as one row per user (postgres and sqlite)", &c.DB.UsersTable},
+		{"cors-origins", "APP_CORS_ORIGINS", "comma separated allowed CORS origins", &c.CORS.Origins},
+		{"cors-headers", "APP_CORS_HEADERS", "comma separated allowed CORS headers", &c.CORS.Headers},
+		{"http-read-timeout", "APP_HTTP_READ_TIMEOUT", "HTTP read timeout", &c.HTTP.ReadTimeout},
+		{"http-write-timeout", "APP_HTTP_WRITE_TIMEOUT", "HTTP write timeout, 0 disables it", &c.HTTP.WriteTimeout},
+		{"http-idle-timeout", "APP_HTTP_IDLE_TIMEOUT", "HTTP keep-alive idle timeout", &c.HTTP.IdleTimeout},
+		{"shutdown-timeout", "APP_SHUTDOWN_TIMEOUT", "graceful shutdown timeout", &c.HTTP.ShutdownTimeout},
+		{"presence-ttl", "APP_PRESENCE_TTL", "remove galaxy users without a heartbeat for this long, 0 disables it", &c.Presence.TTL},
+		{"presence-sweep", "APP_PRESENCE_SWEEP", "interval of the stale galaxy users sweep, defaults to half the TTL", &c.Presence.Sweep},
+	}
+}
+
+func (s setting) set(v string) error {
+	switch p := s.ptr.(type) {
+	case *string:
+		*p = v
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.flag, err)
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.flag, err)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.flag, err)
+		}
+		*p = d
+	case *[]string:
+		*p = splitList(v)
+	}
+
+	return nil
+}
+
+// flagFunc is a flag that hands its value to fn, a bool flag may be given
+// without a value like -db-notify.
+type flagFunc struct {
+	isBool bool
+	fn     func(string) error
+}
+
+func (f flagFunc) String() string     { return "" }
+func (f flagFunc) Set(v string) error { return f.fn(v) }
+func (f flagFunc) IsBoolFlag() bool   { return f.isBool }
+
+func splitList(v string) []string {
+	list := []string{}
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// loadConfig builds the configuration from defaults, an optional YAML file,
+// environment variables and command line flags, each overriding the former.
+func loadConfig(args []string) (*config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("jsondb", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("APP_CONFIG"), "YAML configuration file")
+	flags := make(map[string]string)
+	for _, s := range c.settings() {
+		name := s.flag
+		_, isBool := s.ptr.(*bool)
+		fs.Var(flagFunc{isBool, func(v string) error {
+			flags[name] = v
+			return nil
+		}}, name, s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+
+	for _, s := range c.settings() {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, s := range c.settings() {
+		if v, ok := flags[s.flag]; ok {
+			if err := s.set(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c, c.validate()
+}
+
+func (c *config) validate() error {
+	switch c.Store {
+	case "postgres":
+		switch c.DB.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			return fmt.Errorf("invalid db sslmode %q", c.DB.SSLMode)
+		}
+	case "mssql", "memory":
+	case "sqlite":
+		if c.DB.Path == "" {
+			return fmt.Errorf("db path is required for the sqlite store")
+		}
+	default:
+		return fmt.Errorf("unknown store %q", c.Store)
+	}
+
+	if c.DB.UsersTable && c.Store != "postgres" && c.Store != "sqlite" {
+		return fmt.Errorf("the users table needs the postgres or sqlite store")
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("listen address is required")
+	}
+	if c.DB.Port < 0 || c.DB.Port > 65535 {
+		return fmt.Errorf("invalid db port %d", c.DB.Port)
+	}
+	if c.DB.MaxOpenConns < 0 || c.DB.MaxIdleConns < 0 {
+		return fmt.Errorf("db pool limits must not be negative")
+	}
+	if c.DB.MaxOpenConns > 0 && c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		return fmt.Errorf("db max idle connections exceed max open connections")
+	}
+	if c.DB.ConnMaxLifetime < 0 || c.DB.ConnMaxIdleTime < 0 || c.DB.ConnectTimeout < 0 {
+		return fmt.Errorf("db timeouts must not be negative")
+	}
+	if c.HTTP.ReadTimeout < 0 || c.HTTP.WriteTimeout < 0 || c.HTTP.IdleTimeout < 0 || c.HTTP.ShutdownTimeout < 0 {
+		return fmt.Errorf("http timeouts must not be negative")
+	}
+	if c.Presence.TTL < 0 || c.Presence.Sweep < 0 {
+		return fmt.Errorf("presence durations must not be negative")
+	}
+	if len(c.CORS.Origins) == 0 {
+		return fmt.Errorf("at least one CORS origin is required")
+	}
+
+	return nil
+}
+
+// dsn returns the connection string for the configured store.
+func (c *config) dsn() string {
+	if c.DB.DSN != "" {
+		return c.DB.DSN
+	}
+
+	host := c.DB.Host
+	if c.DB.Port != 0 {
+		host += ":" + strconv.Itoa(c.DB.Port)
+	}
+
+	q := url.Values{}
+	switch c.Store {
+	case "postgres":
+		q.Set("sslmode", c.DB.SSLMode)
+		if c.DB.ConnectTimeout > 0 {
+			q.Set("connect_timeout", strconv.Itoa(int(c.DB.ConnectTimeout.Seconds())))
+		}
+		u := url.URL{Scheme: "postgres", User: url.UserPassword(c.DB.User, c.DB.Password), Host: host, Path: "/" + c.DB.Name, RawQuery: q.Encode()}
+		return u.String()
+	case "mssql":
+		q.Set("database", c.DB.Name)
+		if c.DB.ConnectTimeout > 0 {
+			q.Set("dial timeout", strconv.Itoa(int(c.DB.ConnectTimeout.Seconds())))
+		}
+		u := url.URL{Scheme: "sqlserver", User: url.UserPassword(c.DB.User, c.DB.Password), Host: host, RawQuery: q.Encode()}
+		return u.String()
+	default:
+		return c.DB.Path
+	}
+}
+
+// dsnPassword matches the password of a keyword DSN, postgres style with
+// spaces and quotes or SQL Server style with semicolons and braces.
+var dsnPassword = regexp.MustCompile(`(?i)\b(password|pwd)\s*=\s*('(?:[^'\\]|\\.)*'|"[^"]*"|\{[^}]*\}|[^\s;&]*)`)
+
+// String renders the effective configuration with secrets masked.
+func (c *config) String() string {
+	m := *c
+	if m.DB.Password != "" {
+		m.DB.Password = "****"
+	}
+	if u, err := url.Parse(m.DB.DSN); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "****")
+			m.DB.DSN = u.String()
+		}
+	}
+	m.DB.DSN = dsnPassword.ReplaceAllString(m.DB.DSN, "$1=****")
+
+	b, _ := yaml.Marshal(&m)
+
+	return string(b)
+}
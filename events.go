@@ -0,0 +1,253 @@
+// events.go
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+type change struct {
+	ID      uint64      `json:"id"`
+	Op      string      `json:"op"`
+	Tag     string      `json:"tag"`
+	StateID string      `json:"state_id"`
+	Key     string      `json:"key,omitempty"`
+	Value   interface{} `json:"value"`
+	// Rev is the revision of the state after the change, 0 for changes of
+	// no stored state.
+	Rev int `json:"rev,omitempty"`
+}
+
+// topic selects the changes a subscriber is interested in. Empty fields
+// match anything.
+type topic struct {
+	Tag     string `json:"tag,omitempty"`
+	StateID string `json:"state_id,omitempty"`
+	Key     string `json:"key,omitempty"`
+}
+
+func (t topic) matches(c change) bool {
+	if c.Op == "resync" {
+		return true
+	}
+	if t.Tag != "" && t.Tag != c.Tag {
+		return false
+	}
+	if t.StateID != "" && t.StateID != c.StateID {
+		return false
+	}
+	// Changes below a key, with a JSON Pointer key, match its topic.
+	if t.Key != "" && c.Key != "" && t.Key != keyPointer(c.Key)[0] {
+		return false
+	}
+
+	return true
+}
+
+// project narrows a whole-state change to the subscribed key.
+func (t topic) project(c change) change {
+	if t.Key == "" || c.Key != "" {
+		return c
+	}
+
+	c.Key = t.Key
+	if data, ok := c.Value.(map[string]interface{}); ok {
+		c.Value = data[t.Key]
+	} else {
+		c.Value = nil
+	}
+
+	return c
+}
+
+type subscription struct {
+	C      chan change
+	mu     sync.Mutex
+	topics map[topic]bool
+}
+
+func (s *subscription) add(t topic) {
+	s.mu.Lock()
+	s.topics[t] = true
+	s.mu.Unlock()
+}
+
+func (s *subscription) remove(t topic) {
+	s.mu.Lock()
+	delete(s.topics, t)
+	s.mu.Unlock()
+}
+
+func (s *subscription) match(c change) (change, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for t := range s.topics {
+		if t.matches(c) {
+			return t.project(c), true
+		}
+	}
+
+	return c, false
+}
+
+// hubBacklog is the number of recent changes kept for subscribers resuming
+// after a reconnect.
+const hubBacklog = 1024
+
+// broadcaster delivers a change to the hubs of every instance.
+type broadcaster interface {
+	broadcast(c change)
+}
+
+type hub struct {
+	mu        sync.Mutex
+	subs      map[*subscription]bool
+	seq       uint64
+	backlog   []change
+	observers []func(c change)
+}
+
+// newHub starts the change IDs at a random point, so that the IDs of
+// another process, from before a restart or of another instance, are not
+// mistaken for changes of this one. IDs stay below 2^53 to survive JSON.
+func newHub() *hub {
+	return &hub{subs: make(map[*subscription]bool), seq: uint64(rand.Int63n(1 << 52))}
+}
+
+func (h *hub) subscribe(topics ...topic) *subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.add(0, topics)
+}
+
+// subscribeSince also replays the matching backlog changes newer than id.
+// When the backlog does not cover id the subscriber gets a resync instead
+// and has to fetch the states again.
+func (h *hub) subscribeSince(id uint64, topics ...topic) *subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id > 0 && !h.covered(id) {
+		s := h.add(1, topics)
+		s.C <- change{ID: h.seq, Op: "resync"}
+		return s
+	}
+
+	replay := 0
+	if id > 0 {
+		for _, c := range h.backlog {
+			if c.ID > id {
+				replay++
+			}
+		}
+	}
+
+	s := h.add(replay, topics)
+	for _, c := range h.backlog[len(h.backlog)-replay:] {
+		if m, ok := s.match(c); ok {
+			s.C <- m
+		}
+	}
+
+	return s
+}
+
+// lastID is the ID of the latest change.
+func (h *hub) lastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.seq
+}
+
+// covers reports whether every change after id is still in the backlog.
+func (h *hub) covers(id uint64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.covered(id)
+}
+
+func (h *hub) covered(id uint64) bool {
+	if id > h.seq {
+		return false
+	}
+	if len(h.backlog) == 0 {
+		return id == h.seq
+	}
+
+	return id+1 >= h.backlog[0].ID
+}
+
+func (h *hub) add(replay int, topics []topic) *subscription {
+	s := &subscription{
+		C:      make(chan change, 64+replay),
+		topics: make(map[topic]bool),
+	}
+	for _, t := range topics {
+		s.topics[t] = true
+	}
+	h.subs[s] = true
+
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[s] {
+		delete(h.subs, s)
+		close(s.C)
+	}
+}
+
+// observe calls fn with every published change, after the subscribers got
+// it and outside the hub lock so that fn may publish.
+func (h *hub) observe(fn func(c change)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.observers = append(h.observers, fn)
+}
+
+// publish delivers c to every matching subscriber and then to the
+// observers. Subscribers that fall too far behind are dropped and find
+// their channel closed.
+func (h *hub) publish(c change) {
+	h.mu.Lock()
+
+	h.seq++
+	c.ID = h.seq
+	if len(h.backlog) == hubBacklog {
+		h.backlog = append(h.backlog[:0], h.backlog[1:]...)
+	}
+	h.backlog = append(h.backlog, c)
+
+	for s := range h.subs {
+		m, ok := s.match(c)
+		if !ok {
+			continue
+		}
+		select {
+		case s.C <- m:
+		default:
+			delete(h.subs, s)
+			close(s.C)
+		}
+	}
+
+	observers := h.observers
+	h.mu.Unlock()
+
+	for _, fn := range observers {
+		fn(c)
+	}
+}
+
+func (h *hub) broadcast(c change) {
+	h.publish(c)
+}
@@ -0,0 +1,240 @@
+// events_test.go
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHubTopics(t *testing.T) {
+	h := newHub()
+	byKey := h.subscribe(topic{StateID: "users", Key: "u1"})
+	byTag := h.subscribe(topic{Tag: "other"})
+
+	h.publish(change{Op: "postStateJSON", Tag: "galaxy", StateID: "users", Key: "u2", Value: "x"})
+	h.publish(change{Op: "updateState", Tag: "galaxy", StateID: "users", Value: map[string]interface{}{"u1": "y"}})
+
+	select {
+	case c := <-byKey.C:
+		if c.Key != "u1" || c.Value != "y" {
+			t.Errorf("Expected the update projected to key 'u1'. Got '%v'", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a change for key 'u1'")
+	}
+
+	h.publish(change{Op: "postStatePath", Tag: "galaxy", StateID: "users", Key: "/u1/room", Value: 2})
+	select {
+	case c := <-byKey.C:
+		if c.Key != "/u1/room" {
+			t.Errorf("Expected the nested change below key 'u1'. Got '%v'", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a change below key 'u1'")
+	}
+
+	select {
+	case c := <-byKey.C:
+		t.Errorf("Expected no more changes. Got '%v'", c)
+	case c := <-byTag.C:
+		t.Errorf("Expected no changes for tag 'other'. Got '%v'", c)
+	default:
+	}
+
+	h.unsubscribe(byKey)
+	if _, ok := <-byKey.C; ok {
+		t.Errorf("Expected the channel to be closed")
+	}
+}
+
+func TestSubscribeWS(t *testing.T) {
+	a := newTestApp(t)
+	srv := httptest.NewServer(a.Router)
+	defer srv.Close()
+
+	// The socket lives under /_ws, a tag may be called ws.
+	executeTestRequest(a, "PUT", "/ws/one", `{"a":1}`, nil)
+	if rr := executeTestRequest(a, "GET", "/ws", "", nil); rr.Code != http.StatusOK || rr.Body.String() != `{"one":{"a":1}}` {
+		t.Errorf("Expected the states of tag ws. Got %d %s", rr.Code, rr.Body.String())
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/_ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]string{"action": "subscribe", "state_id": "room"})
+
+	// The subscription is registered asynchronously, keep writing until the
+	// first change arrives.
+	done := make(chan change)
+	go func() {
+		var c change
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.ReadJSON(&c)
+		done <- c
+	}()
+
+	for {
+		req, _ := http.NewRequest("PUT", srv.URL+"/galaxy/room", bytes.NewBufferString(`{"name":"main"}`))
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case c := <-done:
+			if c.Op != "postState" || c.StateID != "room" || c.Tag != "galaxy" {
+				t.Errorf("Unexpected change '%v'", c)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestStreamEventsResume(t *testing.T) {
+	a := newTestApp(t)
+	srv := httptest.NewServer(a.Router)
+	defer srv.Close()
+
+	start := a.events.lastID()
+	a.events.publish(change{Op: "postState", Tag: "galaxy", StateID: "room"})
+	a.events.publish(change{Op: "postState", Tag: "galaxy", StateID: "other"})
+	a.events.publish(change{Op: "deleteState", Tag: "galaxy", StateID: "room"})
+
+	read := func(last uint64) string {
+		req, _ := http.NewRequest("GET", srv.URL+"/_events/galaxy/room", nil)
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(last, 10))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Expected an event stream. Got '%v'", ct)
+		}
+		buf := make([]byte, 512)
+		n, _ := resp.Body.Read(buf)
+		return string(buf[:n])
+	}
+
+	if got := read(start + 1); !strings.HasPrefix(got, fmt.Sprintf("id: %d\ndata: ", start+3)) || !strings.Contains(got, `"op":"deleteState"`) {
+		t.Errorf("Expected only the missed change 3 to be replayed. Got '%v'", got)
+	}
+
+	// IDs the hub cannot vouch for, of another process or from the future,
+	// get a resync.
+	for _, last := range []uint64{start - 1, start + 4} {
+		if got := read(last); !strings.Contains(got, `"op":"resync"`) || strings.Contains(got, `"op":"deleteState"`) {
+			t.Errorf("%d: expected a resync. Got '%v'", last, got)
+		}
+	}
+}
+
+func TestEventsStateID(t *testing.T) {
+	a := newTestApp(t)
+	srv := httptest.NewServer(a.Router)
+	defer srv.Close()
+
+	do := func(method, path, body string) string {
+		req, _ := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var b bytes.Buffer
+		b.ReadFrom(resp.Body)
+		return b.String()
+	}
+
+	// The stream lives under /_events, a state may be called events.
+	do("PUT", "/test/events", `{"a":1}`)
+	if got := do("GET", "/test/events", ""); got != `{"a":1}` {
+		t.Errorf("Expected the state events. Got %s", got)
+	}
+	do("PUT", "/test/one", `{"events":{"b":1}}`)
+	if got := do("GET", "/test/one/events", ""); got != `{"b":1}` {
+		t.Errorf("Expected the key events. Got %s", got)
+	}
+}
+
+func TestStreamEventsResumeFromHistory(t *testing.T) {
+	a := newTestApp(t)
+	srv := httptest.NewServer(a.Router)
+	defer srv.Close()
+
+	executeTestRequest(a, "PUT", "/test/one", `{"a":1}`, nil)
+	executeTestRequest(a, "PUT", "/test/one/b", `{"x":2}`, nil)
+	executeTestRequest(a, "DELETE", "/test/one/a", ``, nil)
+
+	// The stream never ends, it is read until the client gives up.
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	read := func(last string) string {
+		req, _ := http.NewRequest("GET", srv.URL+"/_events/test/one", nil)
+		req.Header.Set("Last-Event-ID", last)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	// The hub ID is of another instance, the revision is enough.
+	got := read("1.1")
+	if !strings.HasPrefix(got, "id: 0.2\ndata: ") || !strings.Contains(got, `"op":"postStateJSON","tag":"test","state_id":"one","key":"b","value":{"x":2},"rev":2`) ||
+		!strings.Contains(got, "id: 0.3\ndata: ") || !strings.Contains(got, `"op":"deleteStateJSON"`) {
+		t.Errorf("Expected revisions 2 and 3 from the history. Got '%v'", got)
+	}
+
+	// Writes left out of the history make it incomplete.
+	s := state{StateID: "one", NoHistory: true}
+	a.Store.PostStateValue(&s, 3.0, "c")
+	for _, last := range []string{"1.1", "1.9"} {
+		if got := read(last); !strings.Contains(got, `"op":"resync"`) {
+			t.Errorf("%s: expected a resync. Got '%v'", last, got)
+		}
+	}
+}
+
+func TestWritesToMissingStateNotPublished(t *testing.T) {
+	a := newTestApp(t)
+	sub := a.events.subscribe(topic{})
+	defer a.events.unsubscribe(sub)
+
+	for _, req := range [][3]string{
+		{"PUT", "/app/missing/k", `{"a":1}`},
+		{"POST", "/app/missing/k", `v`},
+		{"POST", "/app/missing", `{"a":1}`},
+		{"DELETE", "/app/missing/k", ``},
+		{"DELETE", "/app/missing", ``},
+	} {
+		rr := executeTestRequest(a, req[0], req[1], req[2], nil)
+		if rr.Code != http.StatusOK || rr.Header().Get("ETag") != "" {
+			t.Errorf("%s %s: expected 200 without an ETag. Got %d %s", req[0], req[1], rr.Code, rr.Header().Get("ETag"))
+		}
+	}
+
+	select {
+	case c := <-sub.C:
+		t.Errorf("Expected no change to be published. Got %s", c.Op)
+	default:
+	}
+}
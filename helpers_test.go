@@ -0,0 +1,29 @@
+// helpers_test.go
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestApp(t *testing.T) *App {
+	a := &App{}
+	a.InitializeStore(newTestMemoryStore(t))
+
+	return a
+}
+
+func executeTestRequest(a *App, method, url, body string, header map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	return rr
+}
@@ -0,0 +1,317 @@
+// history.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// revision is one entry of state_history. For key operations the old and
+// new values are those of the key, otherwise of the whole state. A missing
+// value means the key or the state did not exist.
+type revision struct {
+	StateID  string          `json:"state_id"`
+	Rev      int             `json:"rev"`
+	Op       string          `json:"op"`
+	Key      string          `json:"key,omitempty"`
+	OldValue json.RawMessage `json:"old_value"`
+	NewValue json.RawMessage `json:"new_value"`
+	Client   string          `json:"client,omitempty"`
+	Time     time.Time       `json:"timestamp"`
+}
+
+// historyValue extracts the recorded value of key from a state document.
+func historyValue(doc []byte, key string) json.RawMessage {
+	if doc == nil || key == "" {
+		return doc
+	}
+
+	if !strings.HasPrefix(key, "/") {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(doc, &m); err != nil {
+			return nil
+		}
+		return m[key]
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil
+	}
+
+	v, ok := keyValue(m, key)
+	if !ok {
+		return nil
+	}
+	b, _ := json.Marshal(v)
+
+	return b
+}
+
+// historySQL holds the statements writeWithHistory runs for a SQL store.
+type historySQL struct {
+	// lock serializes writers of a state_id, even one that does not exist.
+	lock    string
+	current string
+	// value selects the value at a path of the data and the revision of a
+	// state, given the state_id and the path as a JSON array of its keys.
+	// Without it the values are extracted from the data in Go.
+	value   string
+	lastRev string
+	insert  string
+	// touch sets the modification time of a state.
+	touch string
+	// update replaces the data of a state, given the state_id, the data and
+	// the revision.
+	update string
+	// notify, when set, sends the payload of a change and tag reads the tag
+	// of a state for it.
+	notify string
+	tag    string
+}
+
+// writeWithHistory runs apply inside a transaction with the next revision
+// number of the state and records the change in state_history. Key
+// operations on a state that does not exist are not recorded. The state's
+// precondition is checked against the current revision first.
+func writeWithHistory(db *sql.DB, q historySQL, s *state, op, key string, apply func(tx *sql.Tx, rev int) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if q.lock != "" {
+		if _, err := tx.Exec(q.lock, s.StateID); err != nil {
+			return err
+		}
+	}
+
+	old, rev, err := q.read(tx, s.StateID, key)
+	exists := err == nil
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(q.lastRev, s.StateID).Scan(&rev)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.Cond.check(exists, rev); err != nil {
+		return err
+	}
+
+	// The tag is read before a delete takes it away.
+	tag := s.Tag
+	if q.notify != "" {
+		var t sql.NullString
+		err := tx.QueryRow(q.tag, s.StateID).Scan(&t)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if t.Valid {
+			tag = t.String
+		}
+	}
+
+	if err := apply(tx, rev+1); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(q.touch, s.StateID); err != nil {
+		return err
+	}
+
+	newValue, next, err := q.read(tx, s.StateID, key)
+	if err == sql.ErrNoRows {
+		if !exists {
+			return nil
+		}
+		next = rev + 1
+	} else if err != nil {
+		return err
+	}
+	if next != rev+1 {
+		// Nothing was written.
+		return nil
+	}
+
+	if !s.NoHistory {
+		if _, err := tx.Exec(q.insert, s.StateID, next, op, key, nullJSON(old), nullJSON(newValue), s.Client); err != nil {
+			return err
+		}
+	}
+
+	c := change{Op: op, Tag: tag, StateID: s.StateID, Key: key, Value: newValue, Rev: next}
+	if err := notifyWrite(tx, q, c); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.Rev = next
+
+	return nil
+}
+
+// read returns the recorded value of key in a state and its revision, or
+// sql.ErrNoRows when the state does not exist.
+func (q historySQL) read(tx *sql.Tx, stateID, key string) (json.RawMessage, int, error) {
+	var v []byte
+	var rev int
+	if q.value == "" {
+		err := tx.QueryRow(q.current, stateID).Scan(&v, &rev)
+		return historyValue(v, key), rev, err
+	}
+
+	path := []string{}
+	if key != "" {
+		path = keyPointer(key)
+	}
+	p, _ := json.Marshal(path)
+	err := tx.QueryRow(q.value, stateID, string(p)).Scan(&v, &rev)
+
+	return v, rev, err
+}
+
+// modifyWithHistory is writeWithHistory for a read-modify-write of the
+// data of an existing state.
+func modifyWithHistory(db *sql.DB, q historySQL, s *state, op, key string, fn modifier) error {
+	return writeWithHistory(db, q, s, op, key, func(tx *sql.Tx, rev int) error {
+		var obj []byte
+		var cur int
+		if err := tx.QueryRow(q.current, s.StateID).Scan(&obj, &cur); err != nil {
+			return err
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal(obj, &data); err != nil {
+			return err
+		}
+
+		data, err := fn(data)
+		if err != nil {
+			return err
+		}
+
+		v, _ := json.Marshal(data)
+		if _, err := tx.Exec(q.update, s.StateID, string(v), rev); err != nil {
+			return err
+		}
+		s.Data = data
+
+		return nil
+	})
+}
+
+// notifyWrite sends the change of a write inside its transaction, for the
+// stores that notify other instances.
+func notifyWrite(tx *sql.Tx, q historySQL, c change) error {
+	if q.notify == "" {
+		return nil
+	}
+
+	_, err := tx.Exec(q.notify, pgPayload(c))
+	return err
+}
+
+func nullJSON(v json.RawMessage) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	return string(v)
+}
+
+// stateAt rebuilds the data of a state as of revision rev by undoing the
+// newer history entries on top of the current data.
+func stateAt(store Store, s *state, rev int) error {
+	err := store.GetState(s)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	exists := err == nil
+	if exists && rev >= s.Rev {
+		if rev > s.Rev {
+			return sql.ErrNoRows
+		}
+		return nil
+	}
+
+	history, err := store.GetHistory(s.StateID, rev, 0)
+	if err != nil {
+		return err
+	}
+	if !exists && len(history) == 0 {
+		return sql.ErrNoRows
+	}
+
+	data := s.Data
+	if !exists {
+		data = nil
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		h := history[i]
+		if h.Key == "" {
+			data = nil
+			if h.OldValue != nil {
+				json.Unmarshal(h.OldValue, &data)
+			}
+			continue
+		}
+
+		if data == nil {
+			continue
+		}
+		path := keyPointer(h.Key)
+		if h.OldValue == nil {
+			if d, err := pathDelete(data, path); err == nil {
+				data = d
+			}
+			continue
+		}
+		var v interface{}
+		json.Unmarshal(h.OldValue, &v)
+		if d, err := pathSet(data, path, v); err == nil {
+			data = d
+		}
+	}
+
+	if data == nil {
+		return sql.ErrNoRows
+	}
+
+	s.Data = data
+	s.Rev = rev
+
+	return nil
+}
+
+func scanHistory(stateID string, rows *sql.Rows) ([]revision, error) {
+	defer rows.Close()
+
+	history := []revision{}
+
+	for rows.Next() {
+		h := revision{StateID: stateID}
+		var old, cur []byte
+		if err := rows.Scan(&h.Rev, &h.Op, &h.Key, &old, &cur, &h.Client, &h.Time); err != nil {
+			return nil, err
+		}
+		if old != nil {
+			h.OldValue = json.RawMessage(old)
+		}
+		if cur != nil {
+			h.NewValue = json.RawMessage(cur)
+		}
+		history = append(history, h)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,70 @@
+// history_test.go
+
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func testStoreHistory(t *testing.T, store Store) {
+	s := state{StateID: "room", Tag: "galaxy", Client: "alice", Data: map[string]interface{}{"a": "1"}}
+	store.PostState(&s)
+	store.PostStateValue(&s, "2", "b")
+	store.DeleteStateJSON(&s, "a")
+	if s.Rev != 3 {
+		t.Errorf("Expected revision 3. Got '%v'", s.Rev)
+	}
+
+	missing := state{StateID: "missing"}
+	store.PostStateValue(&missing, "x", "k")
+
+	history, err := store.GetHistory("room", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 revisions. Got '%v'", history)
+	}
+	if h := history[2]; h.Op != "deleteStateJSON" || h.Key != "a" || string(h.OldValue) != `"1"` || h.NewValue != nil || h.Client != "alice" {
+		t.Errorf("Unexpected revision '%+v'", h)
+	}
+	if last, _ := store.GetHistory("room", 1, 1); len(last) != 1 || last[0].Rev != 3 {
+		t.Errorf("Expected the last revision only. Got '%v'", last)
+	}
+	if last, _ := store.GetHistory("room", 0, 5); len(last) != 3 || last[0].Rev != 1 {
+		t.Errorf("Expected every revision under a larger limit. Got '%v'", last)
+	}
+
+	if history, _ := store.GetHistory("missing", 0, 0); len(history) != 0 {
+		t.Errorf("Expected no history for a missing state. Got '%v'", history)
+	}
+
+	store.DeleteState(&s)
+
+	old := state{StateID: "room"}
+	if err := stateAt(store, &old, 2); err != nil {
+		t.Fatal(err)
+	}
+	if old.Data["a"] != "1" || old.Data["b"] != "2" {
+		t.Errorf("Expected revision 2 to hold 'a' and 'b'. Got '%v'", old.Data)
+	}
+
+	if err := stateAt(store, &old, 4); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for the deleted revision. Got '%v'", err)
+	}
+
+	s.Data = map[string]interface{}{"c": "3"}
+	store.PostState(&s)
+	if s.Rev != 5 {
+		t.Errorf("Expected revisions to continue after a delete. Got '%v'", s.Rev)
+	}
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	testStoreHistory(t, newTestMemoryStore(t))
+}
+
+func TestSQLiteStoreHistory(t *testing.T) {
+	testStoreHistory(t, newTestSQLiteStore(t))
+}
@@ -0,0 +1,326 @@
+// jsonpatch.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidPatch  = errors.New("Invalid patch")
+	errPatchConflict = errors.New("Patch conflict")
+)
+
+// jsonPatchOp is one operation of an RFC 6902 JSON Patch.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func patchError(base error, format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", base, fmt.Sprintf(format, a...))
+}
+
+// parseJSONPatch decodes and validates a JSON Patch document.
+func parseJSONPatch(b []byte) ([]jsonPatchOp, error) {
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(b, &ops); err != nil {
+		return nil, patchError(errInvalidPatch, "%v", err)
+	}
+
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, patchError(errInvalidPatch, "operation %d: missing path", i)
+		}
+		if _, err := parsePointer(*op.Path); err != nil {
+			return nil, patchError(errInvalidPatch, "operation %d: %v", i, err)
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, patchError(errInvalidPatch, "operation %d: missing value", i)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, patchError(errInvalidPatch, "operation %d: missing from", i)
+			}
+			if _, err := parsePointer(*op.From); err != nil {
+				return nil, patchError(errInvalidPatch, "operation %d: %v", i, err)
+			}
+			if op.Op == "move" && strings.HasPrefix(*op.Path, *op.From+"/") {
+				return nil, patchError(errInvalidPatch, "operation %d: cannot move into a child", i)
+			}
+		case "remove":
+		default:
+			return nil, patchError(errInvalidPatch, "operation %d: unknown op %q", i, op.Op)
+		}
+	}
+
+	return ops, nil
+}
+
+// applyJSONPatch applies the operations to a copy of data, all or none.
+func applyJSONPatch(data map[string]interface{}, ops []jsonPatchOp) (map[string]interface{}, error) {
+	var doc interface{} = cloneMap(data)
+
+	for i, op := range ops {
+		path, _ := parsePointer(*op.Path)
+
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, decodeJSON(op.Value))
+		case "remove":
+			doc, _, err = pointerRemove(doc, path)
+		case "replace":
+			doc, err = pointerReplace(doc, path, decodeJSON(op.Value))
+		case "move":
+			from, _ := parsePointer(*op.From)
+			var v interface{}
+			if doc, v, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, v)
+			}
+		case "copy":
+			from, _ := parsePointer(*op.From)
+			var v interface{}
+			if v, err = pointerGet(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, cloneJSON(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = pointerGet(doc, path); err == nil && !reflect.DeepEqual(v, decodeJSON(op.Value)) {
+				err = patchError(errPatchConflict, "test failed at %q", *op.Path)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, errPatchConflict) {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+			return nil, err
+		}
+	}
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, patchError(errPatchConflict, "the state must remain an object")
+	}
+
+	return m, nil
+}
+
+func decodeJSON(b json.RawMessage) interface{} {
+	var v interface{}
+	json.Unmarshal(b, &v)
+
+	return v
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %q", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token, "-" is accepted as len(a) only
+// when end is set.
+func arrayIndex(a []interface{}, tok string, end bool) (int, error) {
+	if tok == "-" && end {
+		return len(a), nil
+	}
+	if tok == "" || (len(tok) > 1 && tok[0] == '0') || strings.TrimLeft(tok, "0123456789") != "" {
+		return 0, patchError(errPatchConflict, "invalid array index %q", tok)
+	}
+
+	i, err := strconv.Atoi(tok)
+	max := len(a) - 1
+	if end {
+		max = len(a)
+	}
+	if err != nil || i > max {
+		return 0, patchError(errPatchConflict, "array index %q out of range", tok)
+	}
+
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[tok]
+			if !ok {
+				return nil, patchError(errPatchConflict, "path %q not found", tok)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(c, tok, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, patchError(errPatchConflict, "path %q not found", tok)
+		}
+	}
+
+	return doc, nil
+}
+
+// pointerUpdate walks to the parent of the target of path and lets fn
+// change it, returning the updated document.
+func pointerUpdate(doc interface{}, path []string, fn func(parent interface{}, tok string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[path[0]]
+		if !ok {
+			return nil, patchError(errPatchConflict, "path %q not found", path[0])
+		}
+		n, err := pointerUpdate(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[path[0]] = n
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(c, path[0], false)
+		if err != nil {
+			return nil, err
+		}
+		n, err := pointerUpdate(c[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = n
+		return c, nil
+	default:
+		return nil, patchError(errPatchConflict, "path %q not found", path[0])
+	}
+}
+
+func pointerAdd(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+
+	return pointerUpdate(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[tok] = v
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(c, tok, true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		default:
+			return nil, patchError(errPatchConflict, "cannot add to %q", tok)
+		}
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, patchError(errPatchConflict, "cannot remove the whole state")
+	}
+
+	var removed interface{}
+	doc, err := pointerUpdate(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			v, ok := c[tok]
+			if !ok {
+				return nil, patchError(errPatchConflict, "path %q not found", tok)
+			}
+			removed = v
+			delete(c, tok)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(c, tok, false)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, patchError(errPatchConflict, "path %q not found", tok)
+		}
+	})
+
+	return doc, removed, err
+}
+
+func pointerReplace(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+
+	return pointerUpdate(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := c[tok]; !ok {
+				return nil, patchError(errPatchConflict, "path %q not found", tok)
+			}
+			c[tok] = v
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(c, tok, false)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = v
+			return c, nil
+		default:
+			return nil, patchError(errPatchConflict, "path %q not found", tok)
+		}
+	})
+}
+
+// mergePatch applies an RFC 7396 JSON Merge Patch: objects are merged
+// recursively and null removes a member.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
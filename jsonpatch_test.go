@@ -0,0 +1,150 @@
+// jsonpatch_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		doc   string
+		patch string
+		want  string
+		err   error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`, nil},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`, nil},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, errPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, errPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, ``, errPatchConflict},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/01","value":2}]`, ``, errPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, ``, errPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"},{"op":"remove","path":"/nope"}]`, ``, errPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, ``, errInvalidPatch},
+		{`{"foo":"bar"}`, `[{"op":"frob","path":"/baz"}]`, ``, errInvalidPatch},
+		{`{"foo":{}}`, `[{"op":"move","from":"/foo","path":"/foo/bar"}]`, ``, errInvalidPatch},
+	}
+
+	for _, tt := range tests {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(tt.doc), &doc)
+
+		ops, err := parseJSONPatch([]byte(tt.patch))
+		var got map[string]interface{}
+		if err == nil {
+			got, err = applyJSONPatch(doc, ops)
+		}
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: expected '%v'. Got '%v'", tt.patch, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.patch, err)
+			continue
+		}
+
+		var want map[string]interface{}
+		json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %s. Got '%v'", tt.patch, tt.want, got)
+		}
+	}
+}
+
+func TestPatchState(t *testing.T) {
+	a := newTestApp(t)
+	patch := map[string]string{"Content-Type": "application/json-patch+json"}
+
+	executeTestRequest(a, "PUT", "/test/one", `{"users":{"u1":{"room":1}}}`, nil)
+
+	rr := executeTestRequest(a, "PATCH", "/test/one", `[{"op":"add","path":"/users/u1/question","value":true}]`, patch)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected the patch to succeed with ETag \"2\". Got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "PATCH", "/test/one", `[{"op":"remove","path":"/users/u1/room"},{"op":"test","path":"/users/u1/question","value":false}]`, patch)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a failed test. Got %d", rr.Code)
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one", "", nil)
+	if rr.Body.String() != `{"users":{"u1":{"question":true,"room":1}}}` {
+		t.Errorf("Expected a failed patch to change nothing. Got %s", rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "PATCH", "/test/one", `[]`, nil)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 without the patch content type. Got %d", rr.Code)
+	}
+
+	rr = executeTestRequest(a, "PATCH", "/test/missing", `[]`, patch)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing state. Got %d", rr.Code)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range tests {
+		var doc, patch, want interface{}
+		json.Unmarshal([]byte(tt.doc), &doc)
+		json.Unmarshal([]byte(tt.patch), &patch)
+		json.Unmarshal([]byte(tt.want), &want)
+
+		if got := mergePatch(doc, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s + %s: expected %s. Got '%v'", tt.doc, tt.patch, tt.want, got)
+		}
+	}
+}
+
+func TestMergePatchState(t *testing.T) {
+	a := newTestApp(t)
+	merge := map[string]string{"Content-Type": "application/merge-patch+json"}
+
+	executeTestRequest(a, "PUT", "/test/one", `{"users":{"u1":{"room":1,"name":"a"},"u2":{"room":2}}}`, nil)
+
+	rr := executeTestRequest(a, "PATCH", "/test/one", `{"users":{"u1":{"question":true,"name":null}}}`, merge)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the merge patch to succeed. Got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one", "", nil)
+	if rr.Body.String() != `{"users":{"u1":{"question":true,"room":1},"u2":{"room":2}}}` {
+		t.Errorf("Expected a deep merge. Got %s", rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "PATCH", "/test/one", `[1]`, merge)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-object merge patch. Got %d", rr.Code)
+	}
+}
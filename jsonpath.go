@@ -0,0 +1,110 @@
+// jsonpath.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidJSONPath = errors.New("Invalid JSONPath")
+	// errQueryUnsupported is returned by the stores without jsonb_path_query,
+	// an evaluator of their own would answer differently than PostgreSQL.
+	errQueryUnsupported = errors.New("JSONPath queries need the postgres store")
+)
+
+// jsonQuery is a JSONPath query and the values of the $variables it uses.
+type jsonQuery struct {
+	Path string
+	Vars map[string]interface{}
+}
+
+// parseJSONQuery reads a query from ?path, with variables from a ?vars JSON
+// object and any number of ?var=<name>=<value>. Values that are not JSON
+// are strings.
+func parseJSONQuery(r *http.Request) (jsonQuery, error) {
+	q := jsonQuery{Path: r.FormValue("path"), Vars: map[string]interface{}{}}
+	if q.Path == "" {
+		return q, fmt.Errorf("%w: path is required", errInvalidJSONPath)
+	}
+
+	if v := r.FormValue("vars"); v != "" {
+		if err := json.Unmarshal([]byte(v), &q.Vars); err != nil {
+			return q, fmt.Errorf("%w: vars must be an object", errInvalidJSONPath)
+		}
+	}
+
+	for _, v := range r.Form["var"] {
+		i := strings.Index(v, "=")
+		if i <= 0 {
+			return q, fmt.Errorf("%w: invalid var %q", errInvalidJSONPath, v)
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(v[i+1:]), &value); err != nil {
+			value = v[i+1:]
+		}
+		q.Vars[v[:i]] = value
+	}
+
+	return q, nil
+}
+
+func respondWithQueryError(w http.ResponseWriter, err error) {
+	switch {
+	case err == sql.ErrNoRows:
+		respondWithError(w, http.StatusNotFound, "Not Found")
+	case errors.Is(err, errInvalidJSONPath):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case err == errQueryUnsupported:
+		respondWithError(w, http.StatusNotImplemented, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// queryState returns the items a JSONPath query selects in a state.
+func (a *App) queryState(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+
+	q, err := parseJSONQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	items, err := a.Store.QueryState(&s, q)
+	if err != nil {
+		respondWithQueryError(w, err)
+		return
+	}
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, items)
+}
+
+// queryTag runs a JSONPath query on every state of a tag and returns the
+// items selected by state id, leaving out the states without any.
+func (a *App) queryTag(w http.ResponseWriter, r *http.Request) {
+	q, err := parseJSONQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	found, err := a.Store.QueryStates(mux.Vars(r)["tag"], q)
+	if err != nil {
+		respondWithQueryError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, found)
+}
@@ -0,0 +1,39 @@
+// jsonpath_test.go
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestQueryState(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/galaxy/users", `{"u1":{"room":1234,"question":true},"u2":{"room":2}}`, nil)
+
+	// Only PostgreSQL evaluates JSONPath, main_test.go covers the queries.
+	for _, url := range []string{
+		"/_query/galaxy/users?path=" + url.QueryEscape(`$.* ? (@.room == 1234)`),
+		"/_query/galaxy?path=" + url.QueryEscape(`$.*`),
+	} {
+		if rr := executeTestRequest(a, "GET", url, "", nil); rr.Code != http.StatusNotImplemented {
+			t.Errorf("%s: expected 501. Got %d", url, rr.Code)
+		}
+	}
+
+	for _, bad := range []string{
+		"/_query/galaxy/users",
+		"/_query/galaxy?path=" + url.QueryEscape(`$.a`) + "&vars=1",
+	} {
+		if rr := executeTestRequest(a, "GET", bad, "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400. Got %d", bad, rr.Code)
+		}
+	}
+
+	executeTestRequest(a, "PUT", "/galaxy/query", `{"a":1}`, nil)
+	if rr := executeTestRequest(a, "GET", "/galaxy/query", "", nil); rr.Code != http.StatusOK || rr.Body.String() != `{"a":1}` {
+		t.Errorf("Expected the state query. Got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,170 @@
+// longpoll.go
+
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// longPollMax caps the wait of a long-polling request.
+const longPollMax = 2 * time.Minute
+
+var errInvalidWait = errors.New("Invalid wait")
+
+// longPoll reads the ?wait and ?since parameters of a long-polling GET.
+// since is the entity tag the client holds, with or without the quotes, a
+// missing since means the current one.
+func longPoll(r *http.Request) (wait time.Duration, since string, err error) {
+	v := r.FormValue("wait")
+	if v == "" {
+		return 0, "", nil
+	}
+
+	if n, perr := strconv.Atoi(v); perr == nil {
+		wait = time.Duration(n) * time.Second
+	} else if wait, err = time.ParseDuration(v); err != nil {
+		return 0, "", errInvalidWait
+	}
+	if wait <= 0 {
+		return 0, "", errInvalidWait
+	}
+	if wait > longPollMax {
+		wait = longPollMax
+	}
+
+	return wait, strings.Trim(r.FormValue("since"), `"`), nil
+}
+
+// sinceRev reads the revision of a state from since.
+func sinceRev(since string) (rev int64, hasSince bool, err error) {
+	if since == "" {
+		return 0, false, nil
+	}
+
+	rev, err = strconv.ParseInt(since, 10, 64)
+	if err != nil || rev < 0 {
+		return 0, false, errInvalidWait
+	}
+
+	return rev, true, nil
+}
+
+// waitForChange blocks until changed reports true, re-checking it on every
+// event of sub, or until wait expires or the client goes away. It returns
+// whether a change was seen.
+func waitForChange(w http.ResponseWriter, r *http.Request, sub *subscription, wait time.Duration, changed func() (bool, error)) (bool, error) {
+	ok, err := changed()
+	if ok || err != nil {
+		return ok, err
+	}
+
+	// The response must outlive the wait.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case _, open := <-sub.C:
+			if !open {
+				// Dropped by the hub, let the client poll again.
+				return true, nil
+			}
+			if ok, err := changed(); ok || err != nil {
+				return ok, err
+			}
+		case <-timeout.C:
+			return false, nil
+		case <-r.Context().Done():
+			return false, r.Context().Err()
+		}
+	}
+}
+
+// waitForState waits for the state to move past revision since. A deleted
+// state counts as a change unless the client never saw it.
+func (a *App) waitForState(w http.ResponseWriter, r *http.Request, tag, id string, wait time.Duration, since int64, hasSince bool) (bool, error) {
+	sub := a.events.subscribe(topic{Tag: tag, StateID: id})
+	defer a.events.unsubscribe(sub)
+
+	rev := func() (int64, error) {
+		s := state{StateID: id}
+		err := a.Store.GetState(&s)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return int64(s.Rev), err
+	}
+
+	if !hasSince {
+		cur, err := rev()
+		if err != nil {
+			return false, err
+		}
+		since = cur
+	}
+
+	return waitForChange(w, r, sub, wait, func() (bool, error) {
+		cur, err := rev()
+		if err != nil {
+			return false, err
+		}
+		return cur > since || (cur == 0 && since > 0), nil
+	})
+}
+
+// waitForTag waits for the version of tag to differ from since.
+func (a *App) waitForTag(w http.ResponseWriter, r *http.Request, tag string, wait time.Duration, since string) (bool, error) {
+	sub := a.events.subscribe(topic{Tag: tag})
+	defer a.events.unsubscribe(sub)
+
+	return waitForChange(w, r, sub, wait, func() (bool, error) {
+		_, v, err := a.tagStates(tag)
+		return v != since, err
+	})
+}
+
+// tagStates reads the data of the states under tag by state id, and their
+// version from the same read.
+func (a *App) tagStates(tag string) (map[string]interface{}, string, error) {
+	states, err := a.Store.FindStates(search{Tag: tag})
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := make(map[string]interface{}, len(states))
+	for _, s := range states {
+		data[s.StateID] = s.Data
+	}
+
+	return data, tagVersion(states), nil
+}
+
+// tagVersion digests the ids and revisions of the states under a tag. The
+// store keeps them, so every write and delete changes the version the same
+// way on all the instances.
+func tagVersion(states []state) string {
+	sort.Slice(states, func(i, j int) bool { return states[i].StateID < states[j].StateID })
+
+	h := sha1.New()
+	for _, s := range states {
+		fmt.Fprintf(h, "%d:%s:%d\n", s.ID, s.StateID, s.Rev)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// respondNotModified ends a long poll that timed out.
+func respondNotModified(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,130 @@
+// longpoll_test.go
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLongPollState(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/test/one", `{"a":1}`, nil)
+
+	rr := executeTestRequest(a, "GET", "/test/one?wait=1s&since=0", "", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected an immediate answer for an old revision. Got %d '%v'", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one?wait=50ms&since=1", "", nil)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 after the wait expired. Got %d", rr.Code)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		executeTestRequest(a, "POST", "/test/one", `{"a":2}`, nil)
+	}()
+
+	start := time.Now()
+	rr = executeTestRequest(a, "GET", "/test/one?wait=5s&since=1", "", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"2"` || rr.Body.String() != `{"a":2}` {
+		t.Errorf("Expected the changed state. Got %d '%v' %s", rr.Code, rr.Header().Get("ETag"), rr.Body.String())
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the change to end the wait")
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one?wait=soon", "", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid wait. Got %d", rr.Code)
+	}
+}
+
+func TestLongPollTag(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/test/one", `{"a":1}`, nil)
+
+	rr := executeTestRequest(a, "GET", "/test", "", nil)
+	version := rr.Header().Get("ETag")
+	if version == "" {
+		t.Fatalf("Expected an ETag")
+	}
+
+	rr = executeTestRequest(a, "GET", "/test?wait=50ms&since="+version, "", nil)
+	if rr.Code != http.StatusNotModified || rr.Header().Get("ETag") != version {
+		t.Errorf("Expected 304 after the wait expired. Got %d '%v'", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	// Changes under other tags do not end the wait, changes missed in
+	// between do.
+	executeTestRequest(a, "PUT", "/other/one", `{"a":1}`, nil)
+	executeTestRequest(a, "PUT", "/test/two", `{"b":1}`, nil)
+
+	rr = executeTestRequest(a, "GET", "/test?wait=5s&since="+version, "", nil)
+	last := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || last == version || rr.Body.String() != `{"one":{"a":1},"two":{"b":1}}` {
+		t.Errorf("Expected the states with a new ETag. Got %d '%v' %s", rr.Code, last, rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "GET", "/test?wait=50ms&since="+last, "", nil)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 without new changes. Got %d", rr.Code)
+	}
+
+	// The version comes from the store, a deletion and a write of another
+	// instance, seen only as an event, both end the wait.
+	executeTestRequest(a, "DELETE", "/test/two", "", nil)
+	rr = executeTestRequest(a, "GET", "/test?wait=5s&since="+last, "", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"one":{"a":1}}` {
+		t.Errorf("Expected the deletion to end the wait. Got %d %s", rr.Code, rr.Body.String())
+	}
+	last = rr.Header().Get("ETag")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s := state{StateID: "one", Tag: "test", Data: map[string]interface{}{"a": 2.0}}
+		a.Store.PostState(&s)
+		a.events.publish(change{Op: "postState", Tag: "test", StateID: "one", Rev: s.Rev})
+	}()
+	rr = executeTestRequest(a, "GET", "/test?wait=5s&since="+last, "", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"one":{"a":2}}` {
+		t.Errorf("Expected the write to end the wait. Got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "GET", "/test/one?wait=1s&since=abc", "", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a state since that is not a revision. Got %d", rr.Code)
+	}
+}
+
+// readCountingStore counts the reads of the states under a tag.
+type readCountingStore struct {
+	Store
+	reads int
+}
+
+func (c *readCountingStore) FindStates(q search) ([]state, error) {
+	c.reads++
+	return c.Store.FindStates(q)
+}
+
+func (c *readCountingStore) GetStateByTag(tag string) (map[string]interface{}, error) {
+	c.reads++
+	return c.Store.GetStateByTag(tag)
+}
+
+func TestTagReadOnce(t *testing.T) {
+	a := newTestApp(t)
+	executeTestRequest(a, "PUT", "/test/one", `{"a":1}`, nil)
+	store := &readCountingStore{Store: a.Store}
+	a.Store = store
+
+	rr := executeTestRequest(a, "GET", "/test", "", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"one":{"a":1}}` || store.reads != 1 {
+		t.Errorf("Expected the states in a single read. Got %d reads, %d %s", store.reads, rr.Code, rr.Body.String())
+	}
+}
@@ -2,13 +2,23 @@
 
 package main
 
-import "os"
+import (
+	"log"
+	"os"
+)
 
 func main() {
+	c, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("effective configuration:\n%s", c)
+
 	a := App{}
-	a.Initialize(
-		os.Getenv("APP_DB_USERNAME"),
-		os.Getenv("APP_DB_PASSWORD"),
-		os.Getenv("APP_DB_NAME"))
-	a.Run(":8880")
-}
\ No newline at end of file
+	if err := a.Configure(c); err != nil {
+		log.Fatal(err)
+	}
+
+	a.Run(c.Listen)
+}
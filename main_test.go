@@ -8,16 +8,26 @@ import (
 
 	"."
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var a main.App
 
 func TestMain(m *testing.M) {
+	ensureStateTable()
+
 	a = main.App{}
 	a.Initialize(
 		os.Getenv("TEST_DB_USERNAME"),
@@ -39,6 +49,41 @@ func ensureTableExists() {
 	}
 }
 
+func testDSN() string {
+	return fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("TEST_DB_USERNAME"), os.Getenv("TEST_DB_PASSWORD"), os.Getenv("TEST_DB_NAME"))
+}
+
+// ensureStateTable creates the state table the store extends on start.
+func ensureStateTable() {
+	db, err := sql.Open("postgres", testDSN())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(createUStateTable); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// clearStates empties the states and tells the listening instances, which
+// otherwise keep the rooms of the deleted users, to read them again.
+func clearStates() {
+	a.DB.Exec("DELETE FROM state")
+	a.DB.Exec("DELETE FROM state_history")
+	a.DB.Exec(`NOTIFY jsondb_changes, '{"op":"resync"}'`)
+}
+
+func executeStateRequest(method, url, body string, header map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	return executeRequest(req)
+}
+
 func clearTable() {
 	a.DB.Exec("DELETE FROM products")
 	a.DB.Exec("ALTER SEQUENCE products_id_seq RESTART WITH 1")
@@ -395,3 +440,287 @@ func TestDeleteProduct(t *testing.T) {
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
+
+func TestNotifyInsideWrite(t *testing.T) {
+	clearStates()
+
+	l := pq.NewListener(testDSN(), time.Second, time.Minute, nil)
+	defer l.Close()
+	if err := l.Listen("jsondb_changes"); err != nil {
+		t.Fatal(err)
+	}
+
+	executeStateRequest("PUT", "/test/one", `{"a":1}`, nil)
+	select {
+	case m := <-l.Notify:
+		var c map[string]interface{}
+		json.Unmarshal([]byte(m.Extra), &c)
+		if c["op"] != "postState" || c["tag"] != "test" || c["state_id"] != "one" || c["rev"] != 1.0 {
+			t.Errorf("Expected the postState of revision 1. Got %s", m.Extra)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a notification")
+	}
+
+	// A write that fails notifies nothing.
+	rr := executeStateRequest("PUT", "/test/one", `{"a":2}`, map[string]string{"If-Match": `"9"`})
+	checkResponseCode(t, http.StatusPreconditionFailed, rr.Code)
+	select {
+	case m := <-l.Notify:
+		t.Errorf("Expected no notification. Got %s", m.Extra)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// galaxyUsersBody is a users state of rooms users in rooms rooms, some of
+// them with a question.
+func galaxyUsersBody(rooms, perRoom int) string {
+	users := map[string]interface{}{}
+	for i := 0; i < rooms*perRoom; i++ {
+		users[fmt.Sprintf("user-%d", i)] = map[string]interface{}{
+			"room":      i % rooms,
+			"janus":     fmt.Sprintf("gxy%d", i%3),
+			"group":     fmt.Sprintf("group %d", i%rooms),
+			"timestamp": rooms*perRoom - i,
+			"question":  i%7 == 0,
+		}
+	}
+	b, _ := json.Marshal(users)
+
+	return string(b)
+}
+
+func normalize(v interface{}) interface{} {
+	var n interface{}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &n)
+
+	return n
+}
+
+// TestGalaxyRoomsQueries checks the rooms queries against the rooms the
+// application aggregates from the same users.
+func TestGalaxyRoomsQueries(t *testing.T) {
+	clearStates()
+
+	executeStateRequest("PUT", "/galaxy/users", galaxyUsersBody(5, 3), nil)
+
+	rooms, err := a.Store.GetRooms()
+	if err != nil || len(rooms) != 5 {
+		t.Fatalf("Expected 5 rooms. Got %v %v", rooms, err)
+	}
+
+	// The rooms view follows the notifications, it catches up with the write
+	// after the response.
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rr := executeStateRequest("GET", "/galaxy/rooms", "", nil)
+		body = rr.Body.String()
+		var view interface{}
+		json.Unmarshal(rr.Body.Bytes(), &view)
+		if reflect.DeepEqual(normalize(rooms), view) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Expected the rooms %s. Got %v", body, normalize(rooms))
+			break
+		}
+	}
+
+	for i := range rooms {
+		r := rooms[i]
+		id := r.Room
+		if err := a.Store.GetRoom(&r, id); err != nil || !reflect.DeepEqual(r, rooms[i]) {
+			t.Errorf("Expected room %d to match the list. Got %v %v", id, r, err)
+		}
+	}
+
+	r := rooms[0]
+	if err := a.Store.GetRoom(&r, 99); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a room without users. Got %v", err)
+	}
+}
+
+func BenchmarkGetRooms(b *testing.B) {
+	clearStates()
+	executeStateRequest("PUT", "/galaxy/users", galaxyUsersBody(500, 10), nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		a.Store.GetRooms()
+	}
+}
+
+// The rooms listing before it became one query: the first user of every
+// room, then the users of each room in a query of its own.
+const (
+	perRoomListQuery  = "with data as (SELECT jsonb_path_query(data, '$.*') as data FROM state WHERE state_id = 'users') select * from (select distinct on (room) (data -> 'janus')::text as janus,(data -> 'room')::text::bigint as room,(data -> 'group')::text as group,(data -> 'timestamp')::text::bigint as stamp from data where (data -> 'room') is not null order by room,stamp)p order by stamp;"
+	perRoomUsersQuery = "SELECT jsonb_path_query_array(data, '$.* ? (@.room == $room)', $1::jsonb), jsonb_path_exists(data, '$.* ? (@.room == $room && @.question == true)', $1::jsonb) FROM state WHERE state_id = 'users'"
+)
+
+// BenchmarkGetRoomsPerRoom lists the rooms of BenchmarkGetRooms with a
+// query per room, the round trips GetRooms saves.
+func BenchmarkGetRoomsPerRoom(b *testing.B) {
+	clearStates()
+	executeStateRequest("PUT", "/galaxy/users", galaxyUsersBody(500, 10), nil)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rows, err := a.DB.Query(perRoomListQuery)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids := []int{}
+		for rows.Next() {
+			var janus, group []byte
+			var id, stamp int
+			rows.Scan(&janus, &id, &group, &stamp)
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			var users []byte
+			var questions bool
+			if err := a.DB.QueryRow(perRoomUsersQuery, fmt.Sprintf(`{"room":%d}`, id)).Scan(&users, &questions); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkGetRoom(b *testing.B) {
+	clearStates()
+	executeStateRequest("PUT", "/galaxy/users", galaxyUsersBody(500, 10), nil)
+	rooms, _ := a.Store.GetRooms()
+	r := rooms[0]
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		a.Store.GetRoom(&r, i%500)
+	}
+}
+
+func TestQueryState(t *testing.T) {
+	clearStates()
+
+	executeStateRequest("PUT", "/galaxy/users", `{"u1":{"room":1234,"question":true,"tags":["x","y"]},"u2":{"room":2}}`, nil)
+	executeStateRequest("PUT", "/galaxy/lobby", `{"u3":{"room":1234}}`, nil)
+
+	for _, tt := range []struct {
+		path, vars string
+		want       string
+	}{
+		{`$.* ? (@.room == 1234)`, ``, `[{"question":true,"room":1234,"tags":["x","y"]}]`},
+		{`$.* ? (@.room == $room).room`, `&var=room=2`, `[2]`},
+		{`$.* ? (@.tags == "y").room`, ``, `[1234]`},
+		{`$.missing`, ``, `[]`},
+	} {
+		rr := executeStateRequest("GET", "/_query/galaxy/users?path="+url.QueryEscape(tt.path)+tt.vars, "", nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != tt.want {
+			t.Errorf("%s: expected %s. Got %d %s", tt.path, tt.want, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := executeStateRequest("GET", "/_query/galaxy?path="+url.QueryEscape(`$.* ? (@.room == $room)`)+"&vars="+url.QueryEscape(`{"room":1234}`), "", nil)
+	var found map[string][]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &found)
+	if rr.Code != http.StatusOK || len(found) != 2 || len(found["users"]) != 1 || len(found["lobby"]) != 1 {
+		t.Errorf("Expected matches in users and lobby. Got %d %s", rr.Code, rr.Body.String())
+	}
+
+	for _, bad := range []string{
+		"/_query/galaxy/users?path=" + url.QueryEscape(`$.* ?`),
+		"/_query/galaxy/users?path=" + url.QueryEscape(`$.* ? (@.room == $room)`),
+	} {
+		if rr := executeStateRequest("GET", bad, "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400. Got %d", bad, rr.Code)
+		}
+	}
+
+	if rr := executeStateRequest("GET", "/_query/galaxy/none?path=$", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing state. Got %d", rr.Code)
+	}
+}
+
+// TestIncrStatePath runs the cases of the other stores on the SQL
+// arithmetic, array indexes included.
+func TestIncrStatePath(t *testing.T) {
+	clearStates()
+
+	executeStateRequest("PUT", "/galaxy/counters", `{"viewers":1,"rooms":{"r1":{"questions":0}},"name":"x","list":[1]}`, nil)
+
+	for _, tt := range []struct {
+		url  string
+		code int
+		want string
+	}{
+		{"/galaxy/counters/viewers/incr?by=10", http.StatusOK, `11`},
+		{"/galaxy/counters/viewers/decr?by=100&min=0", http.StatusOK, `0`},
+		{"/galaxy/counters/rooms/r1/questions/incr", http.StatusOK, `1`},
+		{"/galaxy/counters/rooms/r2/questions/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/new/incr?by=3", http.StatusOK, `3`},
+		{"/galaxy/counters/name/incr", http.StatusConflict, ``},
+		{"/galaxy/missing/viewers/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/list/0/incr", http.StatusOK, `2`},
+		{"/galaxy/counters/list/-/incr", http.StatusOK, `1`},
+		{"/galaxy/counters/list/2/incr?by=5", http.StatusOK, `5`},
+		{"/galaxy/counters/list/9/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/list/-1/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/list/01/incr", http.StatusNotFound, ``},
+	} {
+		rr := executeStateRequest("POST", tt.url, "", nil)
+		if rr.Code != tt.code {
+			t.Errorf("POST %s: expected %d. Got %d %s", tt.url, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.want != "" && rr.Body.String() != tt.want {
+			t.Errorf("POST %s: expected %s. Got %s", tt.url, tt.want, rr.Body.String())
+		}
+	}
+
+	rr := executeStateRequest("GET", "/galaxy/counters/list", "", nil)
+	if rr.Body.String() != `[2,1,5]` {
+		t.Errorf("Expected the appended counters. Got %s", rr.Body.String())
+	}
+}
+
+// TestArrayStatePath runs the cases of the other stores on the SQL array
+// operations.
+func TestArrayStatePath(t *testing.T) {
+	clearStates()
+
+	executeStateRequest("PUT", "/galaxy/qa", `{"questions":[{"user":"a","text":"x"}],"name":"qa","rooms":{},"tags":[["x","y"],["z"]]}`, nil)
+
+	for _, tt := range []struct {
+		url, body string
+		code      int
+		want      string
+	}{
+		{"/galaxy/qa/questions/append", `{"user":"b","text":"y"}`, http.StatusOK, `[{"text":"x","user":"a"},{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/prepend", `1`, http.StatusOK, `[1,{"text":"x","user":"a"},{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/add", `1`, http.StatusOK, `[1,{"text":"x","user":"a"},{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/remove", `{"match":{"user":"a"}}`, http.StatusOK, `[1,{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/remove", `{"value":1}`, http.StatusOK, `[{"text":"y","user":"b"}]`},
+		{"/galaxy/qa/questions/remove", `{"index":0}`, http.StatusOK, `[]`},
+		{"/galaxy/qa/questions/remove", `{"index":0}`, http.StatusNotFound, ``},
+		{"/galaxy/qa/rooms/janus/add", `"gxy1"`, http.StatusOK, `["gxy1"]`},
+		{"/galaxy/qa/rooms/r2/janus/remove", `{"value":"gxy1"}`, http.StatusNotFound, ``},
+		{"/galaxy/qa/name/append", `1`, http.StatusConflict, ``},
+		{"/galaxy/qa/tags/remove", `{"match":"x"}`, http.StatusOK, `[["z"]]`},
+		{"/galaxy/qa/tags/-/append", `"w"`, http.StatusOK, `["w"]`},
+		{"/galaxy/qa/tags/0/append", `"v"`, http.StatusOK, `["z","v"]`},
+		{"/galaxy/qa/tags/5/append", `"v"`, http.StatusNotFound, ``},
+		{"/galaxy/qa/tags/-1/append", `"v"`, http.StatusNotFound, ``},
+		{"/galaxy/qa/tags/-1/remove", `{"index":0}`, http.StatusNotFound, ``},
+	} {
+		rr := executeStateRequest("POST", tt.url, tt.body, nil)
+		if rr.Code != tt.code {
+			t.Errorf("POST %s %s: expected %d. Got %d %s", tt.url, tt.body, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.want != "" && rr.Body.String() != tt.want {
+			t.Errorf("POST %s %s: expected %s. Got %s", tt.url, tt.body, tt.want, rr.Body.String())
+		}
+	}
+}
@@ -3,10 +3,15 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"strconv"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidKey         = errors.New("invalid key")
+	errPreconditionFailed = errors.New("Precondition Failed")
 )
 
 type state struct {
@@ -14,251 +19,222 @@ type state struct {
 	StateID string                 `json:"state_id"`
 	Data    map[string]interface{} `json:"data"`
 	Tag     string                 `json:"tag"`
-}
-
-type room struct {
-	Janus     string      `json:"janus"`
-	Room      int         `json:"room"`
-	Group     string      `json:"description"`
-	Questions bool        `json:"questions"`
-	NumUsers  int         `json:"num_users"`
-	Users     interface{} `json:"users"`
-}
-
-func getRooms(db *sql.DB) ([]room, error) {
-	rows, err := db.Query(
-		"with data as (SELECT jsonb_path_query(data, '$.*') as data FROM state WHERE state_id = 'users') select * from (select distinct on (room) (data -> 'janus')::text as janus,(data -> 'room')::text::bigint as room,(data -> 'group')::text as group,(data -> 'timestamp')::text::bigint as stamp from data where (data -> 'room') is not null order by room,stamp)p order by stamp;")
-
-	if err != nil {
-		return nil, err
+	Rev     int                    `json:"rev"`
+	Created time.Time              `json:"created_at"`
+	Updated time.Time              `json:"updated_at"`
+	Client  string                 `json:"-"`
+	Cond    *precondition          `json:"-"`
+	// NoHistory writes take a revision but are left out of the history, a
+	// state rebuilt at an older revision keeps the values they wrote.
+	NoHistory bool `json:"-"`
+}
+
+// precondition holds the revisions of a conditional write, from the
+// If-Match and If-None-Match headers. Any matches every existing state.
+type precondition struct {
+	Match        []int
+	MatchAny     bool
+	NoneMatch    []int
+	NoneMatchAny bool
+}
+
+func (p *precondition) check(exists bool, rev int) error {
+	if p == nil {
+		return nil
 	}
 
-	defer rows.Close()
-
-	rooms := []room{}
-
-	for rows.Next() {
-		var r room
-		var st int
-		var o interface{}
-		var obj []byte
-		var grp []byte
-		var gxy []byte
-		if err := rows.Scan(&gxy, &r.Room, &grp, &st); err != nil {
-			return nil, err
-		}
-
-		uq := fmt.Sprintf("SELECT jsonb_path_query_array(data, '$.* ? (@.room == %v)') FROM state WHERE state_id = 'users'", r.Room)
-		qq := fmt.Sprintf("SELECT jsonb_path_exists(data, '$.* ? (@.room == %v && @.question == true)') FROM state WHERE state_id = 'users'", r.Room)
-		err := db.QueryRow(uq).Scan(&obj)
-		if err != nil {
-			return nil, err
-		}
-		err = db.QueryRow(qq).Scan(&r.Questions)
-		if err != nil {
-			return nil, err
-		}
-		json.Unmarshal(obj, &o)
-		json.Unmarshal(gxy, &r.Janus)
-		json.Unmarshal(grp, &r.Group)
-		r.Users = o
-		r.NumUsers = len(o.([]interface{}))
-		rooms = append(rooms, r)
+	if (p.MatchAny || len(p.Match) > 0) && !exists {
+		return errPreconditionFailed
 	}
-
-	return rooms, nil
-}
-
-func (r *room) getRoom(db *sql.DB, id string) error {
-	var o interface{}
-	var obj []byte
-	var grp []byte
-	var gxy []byte
-	rid, _ := strconv.Atoi(id)
-
-	rq := fmt.Sprintf("with data as (SELECT jsonb_path_query_first(data, '$.* ? (@.room == %v)') as data FROM state WHERE state_id = 'users') select * from (select  (data -> 'janus')::text as janus,(data -> 'room')::text::bigint as room, (data -> 'group')::text as group from data) p", rid)
-	uq := fmt.Sprintf("SELECT jsonb_path_query_array(data, '$.* ? (@.room == %v)') FROM state WHERE state_id = 'users'", rid)
-	qq := fmt.Sprintf("SELECT jsonb_path_exists(data, '$.* ? (@.room == %v && @.question == true)') FROM state WHERE state_id = 'users'", rid)
-	err := db.QueryRow(rq).Scan(&gxy, &r.Room, &grp)
-	if err != nil {
-		return err
+	if len(p.Match) > 0 && !containsRev(p.Match, rev) {
+		return errPreconditionFailed
 	}
-
-	err = db.QueryRow(uq).Scan(&obj)
-	if err != nil {
-		return err
+	if p.NoneMatchAny && exists {
+		return errPreconditionFailed
 	}
-
-	err = db.QueryRow(qq).Scan(&r.Questions)
-	if err != nil {
-		return err
+	if exists && containsRev(p.NoneMatch, rev) {
+		return errPreconditionFailed
 	}
 
-	json.Unmarshal(obj, &o)
-	json.Unmarshal(gxy, &r.Janus)
-	json.Unmarshal(grp, &r.Group)
-	r.Users = o
-	r.NumUsers = len(o.([]interface{}))
-
 	return nil
 }
 
-func findStates(db *sql.DB, key string, value string) ([]state, error) {
-	rows, err := db.Query(
-		"SELECT id, state_id, data FROM state WHERE data @> json_build_object($1::text, $2::text)::jsonb",
-		key, value)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer rows.Close()
-
-	states := []state{}
-
-	for rows.Next() {
-		var s state
-		var obj []byte
-		if err := rows.Scan(&s.ID, &s.StateID, &obj); err != nil {
-			return nil, err
+func containsRev(revs []int, rev int) bool {
+	for _, r := range revs {
+		if r == rev {
+			return true
 		}
-		json.Unmarshal(obj, &s.Data)
-		states = append(states, s)
 	}
 
-	return states, nil
+	return false
 }
 
-func getStates(db *sql.DB) ([]state, error) {
-	rows, err := db.Query(
-		"SELECT id, state_id, data, tag FROM state ORDER BY tag")
+type room struct {
+	Janus     string      `json:"janus"`
+	Room      int         `json:"room"`
+	Group     string      `json:"description"`
+	Questions bool        `json:"questions"`
+	NumUsers  int         `json:"num_users"`
+	Users     interface{} `json:"users"`
+}
 
-	if err != nil {
-		return nil, err
+// keyPath builds a SQL/JSON path to a top-level key. SQLite and SQL Server
+// have no usable escaping for quoted labels, so keys containing a double
+// quote are rejected.
+func keyPath(key string) (string, error) {
+	if strings.Contains(key, `"`) {
+		return "", errInvalidKey
 	}
 
-	defer rows.Close()
-
-	states := []state{}
-
-	for rows.Next() {
-		var s state
-		var obj []byte
-		if err := rows.Scan(&s.ID, &s.StateID, &obj, &s.Tag); err != nil {
-			return nil, err
+	return `$."` + key + `"`, nil
+}
+
+// modifier computes the new data of a state from its current data.
+type modifier func(data map[string]interface{}) (map[string]interface{}, error)
+
+type Store interface {
+	GetStates() ([]state, error)
+	GetStateByTag(tag string) (map[string]interface{}, error)
+	FindStates(q search) ([]state, error)
+	GetState(s *state) error
+	PostState(s *state) error
+	UpdateState(s *state) error
+	// PostStateValue sets key to a scalar: a string, a float64, a bool or
+	// nil.
+	PostStateValue(s *state, value interface{}, key string) error
+	PostStateJSON(s *state, value interface{}, key string) error
+	DeleteState(s *state) error
+	DeleteStateJSON(s *state, key string) error
+	// ModifyState replaces the data of an existing state with the result of
+	// fn in one atomic step.
+	ModifyState(s *state, op string, fn modifier) error
+	// The path methods address nested values, see pathSet and pathDelete.
+	GetStatePath(s *state, path []string) (interface{}, error)
+	PostStatePath(s *state, op string, path []string, value interface{}) error
+	DeleteStatePath(s *state, op string, path []string) error
+	// IncrStatePath atomically adds by to the number at path, see pathIncr.
+	IncrStatePath(s *state, op string, path []string, by float64, min, max *float64) (float64, error)
+	// ArrayStatePath atomically runs an array operation, see applyArrayOp.
+	ArrayStatePath(s *state, op string, path []string, a arrayOp) ([]interface{}, error)
+	// QueryState and QueryStates run a JSONPath query, QueryStates on every
+	// state of a tag. Only PostgreSQL runs them, the other stores return
+	// errQueryUnsupported.
+	QueryState(s *state, q jsonQuery) ([]interface{}, error)
+	QueryStates(tag string, q jsonQuery) (map[string][]interface{}, error)
+	// GetHistory returns the revisions after a revision, only the last
+	// limit of them unless limit is 0.
+	GetHistory(stateID string, after, limit int) ([]revision, error)
+	GetRooms() ([]room, error)
+	GetRoom(r *room, id int) error
+	Close() error
+}
+
+// galaxyUsers returns the entries of the galaxy users state in jsonb key
+// order.
+func galaxyUsers(data map[string]interface{}) []map[string]interface{} {
+	users := []map[string]interface{}{}
+	for _, k := range jsonbKeys(data) {
+		if u, ok := data[k].(map[string]interface{}); ok {
+			users = append(users, u)
 		}
-		json.Unmarshal(obj, &s.Data)
-		states = append(states, s)
 	}
 
-	return states, nil
+	return users
 }
 
-func getStateByTag(db *sql.DB, tag string) (map[string]interface{}, error) {
-	rows, err := db.Query(
-		"SELECT id, state_id, data FROM state WHERE tag = $1 ORDER BY state_id DESC",
-		tag)
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer rows.Close()
-
-	states := make(map[string]interface{})
+// aggregateRooms mirrors the galaxy rooms query: one room per distinct room
+// id, described by its earliest user and ordered by that user's timestamp.
+// The users are grouped in a single pass.
+func aggregateRooms(users []map[string]interface{}) []room {
+	rooms := make(map[int]*room)
+	stamps := make(map[int]float64)
+	order := []int{}
 
-	for rows.Next() {
-		var s state
-		var o map[string]interface{}
-		var obj []byte
-		if err := rows.Scan(&s.ID, &s.StateID, &obj); err != nil {
-			return nil, err
+	for _, u := range users {
+		id, ok := roomID(u)
+		if !ok {
+			continue
 		}
-		json.Unmarshal(obj, &o)
-		states[s.StateID] = o
+		st, _ := u["timestamp"].(float64)
+		r, seen := rooms[id]
+		if !seen {
+			nr := newRoom(id, u)
+			nr.Users = []interface{}{}
+			r = &nr
+			rooms[id] = r
+			stamps[id] = st
+			order = append(order, id)
+		} else if st < stamps[id] {
+			r.Janus, _ = u["janus"].(string)
+			r.Group, _ = u["group"].(string)
+			stamps[id] = st
+		}
+		r.add(u)
 	}
 
-	return states, nil
-}
+	sort.Ints(order)
+	sort.SliceStable(order, func(i, j int) bool { return stamps[order[i]] < stamps[order[j]] })
 
-func (s *state) getState(db *sql.DB) error {
-	var obj []byte
-	err := db.QueryRow("SELECT data FROM state WHERE state_id = $1",
-		s.StateID).Scan(&obj)
-	if err != nil {
-		return err
+	list := make([]room, len(order))
+	for i, id := range order {
+		list[i] = *rooms[id]
 	}
-	err = json.Unmarshal(obj, &s.Data)
 
-	return err
+	return list
 }
 
-func (s *state) getStateJSON(db *sql.DB, key string) error {
-	var obj []byte
-	err := db.QueryRow("SELECT data->>$2 FROM state where state_id = $1",
-		s.StateID, key).Scan(&obj)
-	if err != nil {
-		return err
+// findRoom describes the room id the way aggregateRooms does.
+func findRoom(users []map[string]interface{}, id int) (room, bool) {
+	in := []map[string]interface{}{}
+	for _, u := range users {
+		if n, ok := roomID(u); ok && n == id {
+			in = append(in, u)
+		}
 	}
-	err = json.Unmarshal(obj, &s.Data)
-
-	return err
-}
-
-func (s *state) postState(db *sql.DB) error {
-	v, _ := json.Marshal(s.Data)
-
-	err := db.QueryRow(
-		"INSERT INTO state(state_id, data, tag) VALUES($1, $2, $3) ON CONFLICT (state_id) DO UPDATE SET data = $2 WHERE state.state_id = $1 RETURNING id",
-		s.StateID, v, s.Tag).Scan(&s.ID)
-
-	if err != nil {
-		return err
+	if len(in) == 0 {
+		return room{}, false
 	}
 
-	return nil
+	return aggregateRooms(in)[0], true
 }
 
-func (s *state) updateState(db *sql.DB) error {
-	v, _ := json.Marshal(s.Data)
-	_, err :=
-		db.Exec("UPDATE state SET data=$2 WHERE state_id=$1",
-			s.StateID, v)
-
-	return err
+func roomID(u map[string]interface{}) (int, bool) {
+	n, ok := u["room"].(float64)
+	return int(n), ok
 }
 
-func (s *state) postStateStatus(db *sql.DB, value, key string) error {
-	_, err := db.Exec("UPDATE state SET data = data || json_build_object($3::text, $2::bool)::jsonb WHERE state_id=$1",
-		s.StateID, value, key)
+func newRoom(id int, u map[string]interface{}) room {
+	r := room{Room: id}
+	r.Janus, _ = u["janus"].(string)
+	r.Group, _ = u["group"].(string)
 
-	return err
+	return r
 }
 
-func (s *state) postStateValue(db *sql.DB, value string, key string) error {
-	_, err := db.Exec("UPDATE state SET data = data || json_build_object($3::text, $2::text)::jsonb WHERE state_id=$1",
-		s.StateID, value, key)
-
-	return err
-}
-
-func (s *state) postStateJSON(db *sql.DB, value interface{}, key string) error {
-	v, _ := json.Marshal(value)
-	_, err := db.Exec("UPDATE state SET data = data || json_build_object($3::text, $2::jsonb)::jsonb WHERE state_id=$1",
-		s.StateID, v, key)
-
-	return err
+func (r *room) add(u map[string]interface{}) {
+	if q, _ := u["question"].(bool); q {
+		r.Questions = true
+	}
+	r.Users = append(r.Users.([]interface{}), u)
+	r.NumUsers++
 }
 
-func (s *state) deleteState(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM state WHERE state_id=$1", s.StateID)
+// jsonbKeys orders object keys the way PostgreSQL stores them in jsonb:
+// shorter keys first, then bytewise.
+func jsonbKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return jsonbLess(keys[i], keys[j]) })
 
-	return err
+	return keys
 }
 
-func (s *state) deleteStateJSON(db *sql.DB, value string) error {
-	_, err := db.Exec("UPDATE state SET data = data - $2 WHERE state_id=$1",
-		s.StateID, value)
+func jsonbLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
 
-	return err
+	return a < b
 }
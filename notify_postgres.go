@@ -0,0 +1,118 @@
+// notify_postgres.go
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	pgChannel = "jsondb_changes"
+	// NOTIFY payloads are limited to 8000 bytes.
+	pgPayloadLimit = 7900
+	pgPingPeriod   = 90 * time.Second
+)
+
+// pgChange is the NOTIFY payload. Partial changes had their value dropped to
+// fit the payload limit and are completed from the store by the receiver.
+type pgChange struct {
+	change
+	Partial bool `json:"partial,omitempty"`
+}
+
+// pgNotifier shares changes between instances through LISTEN/NOTIFY. Every
+// instance, including the writer, publishes to its own hub what it receives.
+type pgNotifier struct {
+	store    Store
+	hub      *hub
+	listener *pq.Listener
+}
+
+func newPgNotifier(dsn string, store Store, h *hub) (*pgNotifier, error) {
+	n := &pgNotifier{store: store, hub: h}
+	n.listener = pq.NewListener(dsn, time.Second, time.Minute, n.event)
+	if err := n.listener.Listen(pgChannel); err != nil {
+		n.listener.Close()
+		return nil, err
+	}
+
+	go n.run()
+
+	return n, nil
+}
+
+func (n *pgNotifier) event(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventDisconnected:
+		log.Printf("notify: listener disconnected: %v", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		log.Printf("notify: listener reconnect failed: %v", err)
+	case pq.ListenerEventReconnected:
+		// Notifications sent while disconnected are lost, tell subscribers
+		// to fetch the states again.
+		log.Printf("notify: listener reconnected")
+		n.hub.publish(change{Op: "resync"})
+	}
+}
+
+func (n *pgNotifier) run() {
+	for {
+		select {
+		case m, ok := <-n.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification is sent after a reconnect.
+			if m != nil {
+				n.receive(m.Extra)
+			}
+		case <-time.After(pgPingPeriod):
+			go n.listener.Ping()
+		}
+	}
+}
+
+func (n *pgNotifier) receive(payload string) {
+	var m pgChange
+	if err := json.Unmarshal([]byte(payload), &m); err != nil {
+		log.Printf("notify: invalid payload: %v", err)
+		return
+	}
+
+	if m.Partial {
+		s := state{StateID: m.StateID}
+		if err := n.store.GetState(&s); err == nil {
+			if m.Key == "" {
+				m.Value = s.Data
+			} else {
+				m.Value, _ = keyValue(s.Data, m.Key)
+			}
+		}
+	}
+
+	n.hub.publish(m.change)
+}
+
+// broadcast does nothing, the store sends the change of every write inside
+// its transaction, see postgresNotifyHistory.
+func (n *pgNotifier) broadcast(c change) {}
+
+// pgPayload is the NOTIFY payload of a change, without its value when that
+// does not fit.
+func pgPayload(c change) string {
+	b, _ := json.Marshal(pgChange{change: c})
+	if len(b) > pgPayloadLimit {
+		c.Value = nil
+		b, _ = json.Marshal(pgChange{change: c, Partial: true})
+	}
+
+	return string(b)
+}
+
+func (n *pgNotifier) Close() error {
+	return n.listener.Close()
+}
@@ -0,0 +1,68 @@
+// notify_postgres_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestPgNotifierPartial(t *testing.T) {
+	m := newTestMemoryStore(t)
+	big := strings.Repeat("x", pgPayloadLimit)
+	s := state{StateID: "big", Tag: "app", Data: map[string]interface{}{"k": big, "small": 1.0}}
+	m.PostState(&s)
+
+	n := &pgNotifier{store: m, hub: newHub()}
+	sub := n.hub.subscribe(topic{})
+	defer n.hub.unsubscribe(sub)
+
+	for _, c := range []change{
+		{Op: "postStateJSON", Tag: "app", StateID: "big", Key: "k", Value: big, Rev: 1},
+		{Op: "postState", Tag: "app", StateID: "big", Value: s.Data, Rev: 1},
+		{Op: "postStateJSON", Tag: "app", StateID: "big", Key: "small", Value: 1.0, Rev: 1},
+	} {
+		payload := pgPayload(c)
+		if len(payload) > pgPayloadLimit {
+			t.Errorf("%s %s: expected the payload to fit. Got %d bytes", c.Op, c.Key, len(payload))
+		}
+		var p pgChange
+		json.Unmarshal([]byte(payload), &p)
+		if p.Partial != (c.Key != "small") {
+			t.Errorf("%s %s: expected partial %v. Got %v", c.Op, c.Key, c.Key != "small", p.Partial)
+		}
+
+		n.receive(payload)
+		got := <-sub.C
+		want, _ := json.Marshal(c.Value)
+		if b, _ := json.Marshal(got.Value); string(b) != string(want) || got.Rev != 1 || got.Op != c.Op {
+			t.Errorf("%s %s: expected the value to be completed from the store. Got %+v", c.Op, c.Key, got)
+		}
+	}
+}
+
+func TestPgNotifierReconnect(t *testing.T) {
+	n := &pgNotifier{store: newTestMemoryStore(t), hub: newHub()}
+	sub := n.hub.subscribe(topic{StateID: "users"})
+	defer n.hub.unsubscribe(sub)
+
+	n.event(pq.ListenerEventDisconnected, nil)
+	n.event(pq.ListenerEventReconnected, nil)
+
+	select {
+	case c := <-sub.C:
+		if c.Op != "resync" {
+			t.Errorf("Expected a resync. Got %s", c.Op)
+		}
+	default:
+		t.Errorf("Expected a resync after the reconnect")
+	}
+	select {
+	case c := <-sub.C:
+		t.Errorf("Expected a single resync. Got %s", c.Op)
+	default:
+	}
+}
@@ -0,0 +1,355 @@
+// path.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errPathNotFound = errors.New("Not Found")
+	errNotNumber    = errors.New("Value is not a number")
+	errPathTwice    = errors.New("Path given both in the URL and in ?path=")
+)
+
+// formatPointer builds the JSON Pointer of path.
+func formatPointer(path []string) string {
+	var b strings.Builder
+	for _, t := range path {
+		b.WriteByte('/')
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(t))
+	}
+
+	return b.String()
+}
+
+// pathKey is the key recorded in the history and change events for a write
+// to path: the key itself at the top level, a JSON Pointer below it.
+func pathKey(path []string) string {
+	if len(path) == 1 && !strings.HasPrefix(path[0], "/") {
+		return path[0]
+	}
+
+	return formatPointer(path)
+}
+
+// keyPointer returns the path of a history or event key.
+func keyPointer(key string) []string {
+	if strings.HasPrefix(key, "/") {
+		if path, err := parsePointer(key); err == nil {
+			return path
+		}
+	}
+
+	return []string{key}
+}
+
+// keyValue looks up a history or event key in the data of a state.
+func keyValue(data map[string]interface{}, key string) (interface{}, bool) {
+	v, err := pathGet(data, keyPointer(key))
+
+	return v, err == nil
+}
+
+func pathGet(data map[string]interface{}, path []string) (interface{}, error) {
+	v, err := pointerGet(data, path)
+	if err != nil {
+		return nil, errPathNotFound
+	}
+
+	return v, nil
+}
+
+// pathSet sets the value at path, creating the last key. An index one past
+// the end of an array appends to it.
+func pathSet(data map[string]interface{}, path []string, v interface{}) (map[string]interface{}, error) {
+	doc, err := pointerUpdate(data, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			c[tok] = v
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(c, tok, true)
+			if err != nil {
+				return nil, err
+			}
+			if i == len(c) {
+				return append(c, v), nil
+			}
+			c[i] = v
+			return c, nil
+		default:
+			return nil, errPathNotFound
+		}
+	})
+	if err != nil {
+		return nil, errPathNotFound
+	}
+
+	return doc.(map[string]interface{}), nil
+}
+
+// pathDelete removes the value at path. A missing last key is not an error.
+func pathDelete(data map[string]interface{}, path []string) (map[string]interface{}, error) {
+	doc, err := pointerUpdate(data, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			delete(c, tok)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(c, tok, false)
+			if err != nil {
+				return c, nil
+			}
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, errPathNotFound
+		}
+	})
+	if err != nil {
+		return nil, errPathNotFound
+	}
+
+	return doc.(map[string]interface{}), nil
+}
+
+// resolvePath checks path against data with the rules of pathSet and
+// returns it with "-" replaced by the index it stands for. The SQL stores
+// run it before jsonb_set, which appends an index past the end of an array
+// and counts a negative one from the end.
+func resolvePath(data map[string]interface{}, path []string) ([]string, error) {
+	resolved := make([]string, len(path))
+	var doc interface{} = data
+	for i, tok := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			resolved[i] = tok
+			doc = c[tok]
+		case []interface{}:
+			n, err := arrayIndex(c, tok, i == len(path)-1)
+			if err != nil {
+				return nil, errPathNotFound
+			}
+			resolved[i] = strconv.Itoa(n)
+			if n < len(c) {
+				doc = c[n]
+			}
+		default:
+			return nil, errPathNotFound
+		}
+	}
+
+	return resolved, nil
+}
+
+// pathIncr adds by to the number at path, a missing one counting as 0, and
+// clamps the result to min and max when they are set.
+func pathIncr(data map[string]interface{}, path []string, by float64, min, max *float64) (map[string]interface{}, float64, error) {
+	n := 0.0
+	if v, err := pointerGet(data, path); err == nil {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, 0, errNotNumber
+		}
+		n = f
+	}
+
+	n += by
+	if min != nil && n < *min {
+		n = *min
+	}
+	if max != nil && n > *max {
+		n = *max
+	}
+
+	data, err := pathSet(data, path, n)
+
+	return data, n, err
+}
+
+// requestPath returns the path addressed by a request, from the URL
+// segments after the state id on the routes that have them, otherwise from
+// the ?path= JSON Pointer. Those routes reject a ?path= rather than let it
+// address another value than the URL.
+func requestPath(r *http.Request) ([]string, error) {
+	tpl, _ := mux.CurrentRoute(r).GetPathTemplate()
+	if !strings.Contains(tpl, "{path") {
+		path, err := parsePointer(r.FormValue("path"))
+		if err != nil || len(path) == 0 {
+			return nil, errInvalidKey
+		}
+		return path, nil
+	}
+	if _, ok := r.URL.Query()["path"]; ok {
+		return nil, errPathTwice
+	}
+
+	path := strings.Split(mux.Vars(r)["path"], "/")
+	for _, t := range path {
+		if t == "" {
+			return nil, errInvalidKey
+		}
+	}
+
+	return path, nil
+}
+
+func (a *App) getStatePath(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+
+	path, err := requestPath(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	v, err := a.Store.GetStatePath(&s, path)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows, errPathNotFound:
+			respondWithError(w, http.StatusNotFound, "Not Found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, v)
+}
+
+func (a *App) postStatePath(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path, err := requestPath(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var value interface{}
+	if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+		return
+	}
+
+	if err := a.Store.PostStatePath(&s, "postStatePath", path, value); err != nil {
+		respondWithWriteError(w, err)
+		return
+	}
+
+	a.notify(r, s.Rev, "postStatePath", pathKey(path), value)
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) deleteStatePath(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path, err := requestPath(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.Store.DeleteStatePath(&s, "deleteStatePath", path); err != nil {
+		respondWithWriteError(w, err)
+		return
+	}
+
+	a.notify(r, s.Rev, "deleteStatePath", pathKey(path), nil)
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// incrStatePath adds ?by (1 by default) to the number at a path, or
+// subtracts it for decr, and returns the new value.
+func (a *App) incrStatePath(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path, err := requestPath(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	by := 1.0
+	if v := r.FormValue("by"); v != "" {
+		if by, err = parseNumber(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid by")
+			return
+		}
+	}
+	if strings.HasSuffix(r.URL.Path, "/decr") {
+		by = -by
+	}
+
+	min, err := optionalNumber(r, "min")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	max, err := optionalNumber(r, "max")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if min != nil && max != nil && *min > *max {
+		respondWithError(w, http.StatusBadRequest, "min exceeds max")
+		return
+	}
+
+	n, err := a.Store.IncrStatePath(&s, "incrStatePath", path, by, min, max)
+	if err != nil {
+		respondWithWriteError(w, err)
+		return
+	}
+
+	a.notify(r, s.Rev, "incrStatePath", pathKey(path), n)
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, n)
+}
+
+func optionalNumber(r *http.Request, name string) (*float64, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	n, err := parseNumber(v)
+	if err != nil {
+		return nil, errors.New("Invalid " + name)
+	}
+
+	return &n, nil
+}
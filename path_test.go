@@ -0,0 +1,162 @@
+// path_test.go
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStatePath(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/galaxy/users", `{"abc123":{"room":1,"tags":["a"]},"a/b":{"x":1}}`, nil)
+
+	tests := []struct {
+		method, url, body string
+		code              int
+		want              string
+	}{
+		{"GET", "/galaxy/users/abc123/room", "", http.StatusOK, `1`},
+		{"GET", "/galaxy/users/abc123/tags/0", "", http.StatusOK, `"a"`},
+		{"GET", "/galaxy/users/abc123", "", http.StatusOK, `{"room":1,"tags":["a"]}`},
+		{"GET", "/galaxy/users?path=/a~1b/x", "", http.StatusOK, `1`},
+		{"GET", "/galaxy/users/missing/room", "", http.StatusNotFound, ``},
+		{"GET", "/galaxy/users/abc123/missing", "", http.StatusNotFound, ``},
+		{"GET", "/galaxy/nobody/abc123/room", "", http.StatusNotFound, ``},
+		{"PUT", "/galaxy/users/abc123/room", `2`, http.StatusOK, ``},
+		{"PUT", "/galaxy/users/abc123/question", `true`, http.StatusOK, ``},
+		{"PUT", "/galaxy/users/abc123/tags/1", `"b"`, http.StatusOK, ``},
+		{"PUT", "/galaxy/users/missing/room", `1`, http.StatusNotFound, ``},
+		{"PUT", "/galaxy/users?path=/a~1b/y", `{"z":null}`, http.StatusOK, ``},
+		{"DELETE", "/galaxy/users/abc123/tags/0", "", http.StatusOK, ``},
+		{"DELETE", "/galaxy/users/missing/room", "", http.StatusNotFound, ``},
+		{"GET", "/galaxy/users", "", http.StatusOK, `{"a/b":{"x":1,"y":{"z":null}},"abc123":{"question":true,"room":2,"tags":["b"]}}`},
+		{"GET", "/galaxy/users?path=", "", http.StatusBadRequest, ``},
+		{"GET", "/galaxy/users?path=abc", "", http.StatusBadRequest, ``},
+		// A path in the URL leaves no room for ?path=.
+		{"GET", "/galaxy/users/abc123/room?path=/a~1b/x", "", http.StatusBadRequest, ``},
+		{"PUT", "/galaxy/users/abc123/room?path=/a~1b/x", `3`, http.StatusBadRequest, ``},
+		{"POST", "/galaxy/users/abc123/room/incr?path=/a~1b/x", ``, http.StatusBadRequest, ``},
+		{"POST", "/galaxy/users/abc123/tags/append?path=/a~1b/x", `"c"`, http.StatusBadRequest, ``},
+		{"GET", "/galaxy/users", "", http.StatusOK, `{"a/b":{"x":1,"y":{"z":null}},"abc123":{"question":true,"room":2,"tags":["b"]}}`},
+	}
+
+	for _, tt := range tests {
+		rr := executeTestRequest(a, tt.method, tt.url, tt.body, nil)
+		if rr.Code != tt.code {
+			t.Errorf("%s %s: expected %d. Got %d %s", tt.method, tt.url, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.want != "" && rr.Body.String() != tt.want {
+			t.Errorf("%s %s: expected %s. Got %s", tt.method, tt.url, tt.want, rr.Body.String())
+		}
+	}
+
+	rr := executeTestRequest(a, "GET", "/galaxy/users?rev=2", "", nil)
+	if rr.Body.String() != `{"a/b":{"x":1},"abc123":{"room":2,"tags":["a"]}}` {
+		t.Errorf("Expected nested writes to be undone in the history. Got %s", rr.Body.String())
+	}
+
+	rr = executeTestRequest(a, "GET", "/_history/galaxy/users?after=1&limit=1", "", nil)
+	if rr.Body.String() == "" || !strings.Contains(rr.Body.String(), `"key":"/abc123/tags/0"`) {
+		t.Errorf("Expected the JSON Pointer of the change in the history. Got %s", rr.Body.String())
+	}
+	if rr = executeTestRequest(a, "GET", "/galaxy/users/history", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected a missing key history, not the history. Got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPostStateValueTypes(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/test/one", `{}`, nil)
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"s?value=text&type=string", http.StatusOK},
+		{"t?value=42&type=string", http.StatusOK},
+		{"n?value=1.5&type=number", http.StatusOK},
+		{"b?value=true&type=bool", http.StatusOK},
+		{"z?type=null", http.StatusOK},
+		{"on?value=true", http.StatusOK},
+		{"off?value=Off", http.StatusOK},
+		{"status?status=false", http.StatusOK},
+		{"x?value=abc&type=number", http.StatusBadRequest},
+		{"x?value=NaN&type=number", http.StatusBadRequest},
+		{"x?value=maybe&type=boolean", http.StatusBadRequest},
+		{"x?value=0&type=null", http.StatusBadRequest},
+		{"x?value=1&type=date", http.StatusBadRequest},
+		{"x?value=text", http.StatusBadRequest},
+		{"x?value=o", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		rr := executeTestRequest(a, "POST", "/test/one/"+tt.query, "", nil)
+		if rr.Code != tt.code {
+			t.Errorf("POST %s: expected %d. Got %d %s", tt.query, tt.code, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := executeTestRequest(a, "GET", "/test/one", "", nil)
+	// Without a type, value is a boolean and status a string as they always
+	// were.
+	want := `{"b":true,"n":1.5,"off":false,"on":true,"s":"text","status":"false","t":"42","z":null}`
+	if rr.Body.String() != want {
+		t.Errorf("Expected %s. Got %s", want, rr.Body.String())
+	}
+}
+
+func TestIncrStatePath(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/galaxy/counters", `{"viewers":1,"rooms":{"r1":{"questions":0}},"name":"x","list":[1]}`, nil)
+
+	tests := []struct {
+		url  string
+		code int
+		want string
+	}{
+		{"/galaxy/counters/viewers/incr", http.StatusOK, `2`},
+		{"/galaxy/counters/viewers/incr?by=10", http.StatusOK, `12`},
+		{"/galaxy/counters/viewers/decr?by=2.5", http.StatusOK, `9.5`},
+		{"/galaxy/counters/viewers/incr?by=100&max=20", http.StatusOK, `20`},
+		{"/galaxy/counters/viewers/decr?by=100&min=0", http.StatusOK, `0`},
+		{"/galaxy/counters/rooms/r1/questions/incr", http.StatusOK, `1`},
+		{"/galaxy/counters/rooms/r2/questions/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/new/incr?by=3", http.StatusOK, `3`},
+		{"/galaxy/counters/name/incr", http.StatusConflict, ``},
+		{"/galaxy/counters/viewers/incr?by=x", http.StatusBadRequest, ``},
+		{"/galaxy/counters/viewers/incr?min=5&max=1", http.StatusBadRequest, ``},
+		{"/galaxy/missing/viewers/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/list/0/incr", http.StatusOK, `2`},
+		{"/galaxy/counters/list/-/incr", http.StatusOK, `1`},
+		{"/galaxy/counters/list/2/incr?by=5", http.StatusOK, `5`},
+		{"/galaxy/counters/list/9/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/list/-1/incr", http.StatusNotFound, ``},
+		{"/galaxy/counters/list/01/incr", http.StatusNotFound, ``},
+	}
+
+	for _, tt := range tests {
+		rr := executeTestRequest(a, "POST", tt.url, "", nil)
+		if rr.Code != tt.code {
+			t.Errorf("POST %s: expected %d. Got %d %s", tt.url, tt.code, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.want != "" && rr.Body.String() != tt.want {
+			t.Errorf("POST %s: expected %s. Got %s", tt.url, tt.want, rr.Body.String())
+		}
+	}
+
+	rr := executeTestRequest(a, "GET", "/galaxy/counters/rooms/r1/questions", "", nil)
+	if rr.Body.String() != `1` {
+		t.Errorf("Expected the nested counter to be stored. Got %s", rr.Body.String())
+	}
+	rr = executeTestRequest(a, "GET", "/galaxy/counters/list", "", nil)
+	if rr.Body.String() != `[2,1,5]` {
+		t.Errorf("Expected the appended counters. Got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,159 @@
+// presence.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// presenceClient is the client recorded in the history of evictions.
+const presenceClient = "presence"
+
+// heartbeat marks a galaxy user as alive by setting its last_seen, in
+// milliseconds since the epoch like the timestamp the galaxy clients write
+// when they join. A JSON object in the body replaces the entry of the user,
+// with the timestamp set if it has none. An empty body only touches
+// last_seen of an existing entry and is left out of the history. A user
+// that expired gets 404 and sends its entry again.
+func (a *App) heartbeat(w http.ResponseWriter, r *http.Request) {
+	s := state{StateID: usersStateID}
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	user := mux.Vars(r)["user"]
+	now := float64(time.Now().UnixNano() / 1e6)
+
+	var entry map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+		return
+	}
+
+	if entry != nil {
+		if _, ok := entry["timestamp"].(float64); !ok {
+			entry["timestamp"] = now
+		}
+		entry["last_seen"] = now
+		if err := a.Store.PostStateJSON(&s, entry, user); err != nil {
+			respondWithWriteError(w, err)
+			return
+		}
+		if s.Rev == 0 {
+			respondWithError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		a.broadcastUsers(s.Rev, "postStateJSON", user, entry)
+	} else {
+		s.NoHistory = true
+		path := []string{user, "last_seen"}
+		if err := a.Store.PostStatePath(&s, "heartbeat", path, now); err != nil {
+			respondWithWriteError(w, err)
+			return
+		}
+		a.broadcastUsers(s.Rev, "heartbeat", pathKey(path), now)
+	}
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, map[string]float64{"last_seen": now})
+}
+
+func (a *App) broadcastUsers(rev int, op string, key string, value interface{}) {
+	a.broadcast(change{
+		Op:      op,
+		Tag:     galaxyTag,
+		StateID: usersStateID,
+		Key:     key,
+		Value:   value,
+		Rev:     rev,
+	})
+}
+
+// expireUsers removes the galaxy users seen last longer than the presence
+// TTL ago, each with a delete of its key, and announces every removal so
+// the rooms views of all the instances see the users leave. Entries
+// without a timestamp or last_seen never expire.
+//
+// A delete only applies to the revision the user was found stale at, a
+// heartbeat in between fails it and the user is checked again.
+func (a *App) expireUsers(now time.Time) error {
+	cutoff := float64(now.Add(-a.config.Presence.TTL).UnixNano() / 1e6)
+
+	s := state{StateID: usersStateID}
+	err := a.Store.GetState(&s)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, k := range jsonbKeys(s.Data) {
+		for stale(s.Data[k], cutoff) {
+			d := state{StateID: usersStateID, Client: presenceClient, Cond: &precondition{Match: []int{s.Rev}}}
+			err := a.Store.DeleteStateJSON(&d, k)
+			if err == errPreconditionFailed {
+				s = state{StateID: usersStateID}
+				err = a.Store.GetState(&s)
+				if err == nil {
+					continue
+				}
+			}
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			a.broadcastUsers(d.Rev, "deleteStateJSON", k, nil)
+			s.Rev = d.Rev
+			break
+		}
+	}
+
+	return nil
+}
+
+// stale tells whether a user was seen last, by its last_seen or else its
+// timestamp, before cutoff.
+func stale(user interface{}, cutoff float64) bool {
+	u, _ := user.(map[string]interface{})
+	seen, ok := u["last_seen"].(float64)
+	if !ok {
+		seen, ok = u["timestamp"].(float64)
+	}
+
+	return ok && seen < cutoff
+}
+
+// sweepPresence runs expireUsers every sweep interval until stop is closed.
+func (a *App) sweepPresence(stop <-chan struct{}) {
+	every := a.config.Presence.Sweep
+	if every == 0 {
+		every = a.config.Presence.TTL / 2
+	}
+	if every == 0 {
+		every = a.config.Presence.TTL
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			if err := a.expireUsers(now); err != nil {
+				log.Printf("presence: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// presence_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	a := newTestApp(t)
+
+	for _, body := range []string{``, `{"room":1}`} {
+		if rr := executeTestRequest(a, "POST", "/galaxy/users/u1/heartbeat", body, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("%q: expected 404 for a missing users state. Got %d", body, rr.Code)
+		}
+	}
+	executeTestRequest(a, "PUT", "/galaxy/users", `{}`, nil)
+
+	rr := executeTestRequest(a, "POST", "/galaxy/users/u1/heartbeat", `{"room":1,"janus":"gxy1"}`, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200. Got %d %s", rr.Code, rr.Body.String())
+	}
+	var beat map[string]float64
+	json.Unmarshal(rr.Body.Bytes(), &beat)
+
+	before := time.Now().Add(-time.Second).UnixNano() / 1e6
+	u, err := a.Store.GetStatePath(&state{StateID: usersStateID}, []string{"u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := u.(map[string]interface{})
+	if entry["room"] != 1.0 || entry["last_seen"] != beat["last_seen"] || entry["timestamp"] != beat["last_seen"] || beat["last_seen"] < float64(before) {
+		t.Errorf("Expected u1 to be stored as joined and seen now. Got %v %v", entry, beat)
+	}
+	if r, ok := a.rooms.get(1); !ok || r.NumUsers != 1 {
+		t.Errorf("Expected room 1 with u1. Got %v", r)
+	}
+
+	executeTestRequest(a, "PUT", "/galaxy/users/u1", `{"room":1,"timestamp":1,"last_seen":1}`, nil)
+	history, _ := a.Store.GetHistory(usersStateID, 0, 0)
+	if rr := executeTestRequest(a, "POST", "/galaxy/users/u1/heartbeat", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200. Got %d %s", rr.Code, rr.Body.String())
+	}
+	u, _ = a.Store.GetStatePath(&state{StateID: usersStateID}, []string{"u1"})
+	entry = u.(map[string]interface{})
+	if entry["last_seen"].(float64) < float64(before) || entry["timestamp"] != 1.0 {
+		t.Errorf("Expected only last_seen to be touched. Got %v", entry)
+	}
+	if h, _ := a.Store.GetHistory(usersStateID, 0, 0); len(h) != len(history) {
+		t.Errorf("Expected the heartbeat to be left out of the history. Got %v", h[len(history):])
+	}
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{``, http.StatusNotFound},
+		{`[1]`, http.StatusBadRequest},
+		{`{"a"`, http.StatusBadRequest},
+		{`"str"`, http.StatusBadRequest},
+		{`{}`, http.StatusOK},
+		{``, http.StatusOK},
+	} {
+		if rr := executeTestRequest(a, "POST", "/galaxy/users/u2/heartbeat", tc.body, nil); rr.Code != tc.code {
+			t.Errorf("%q: expected %d. Got %d", tc.body, tc.code, rr.Code)
+		}
+	}
+}
+
+func TestExpireUsers(t *testing.T) {
+	a := newTestApp(t)
+	a.config.Presence.TTL = time.Minute
+	sub := a.events.subscribe(topic{StateID: roomsStateID})
+	defer a.events.unsubscribe(sub)
+
+	now := time.Now()
+	ms := func(d time.Duration) float64 { return float64(now.Add(-d).UnixNano() / 1e6) }
+	users := state{StateID: usersStateID, Tag: galaxyTag, Data: map[string]interface{}{
+		"u1": map[string]interface{}{"room": 1.0, "timestamp": ms(2 * time.Minute)},
+		"u2": map[string]interface{}{"room": 1.0, "timestamp": ms(time.Hour), "last_seen": ms(time.Second)},
+		"u3": map[string]interface{}{"room": 2.0, "timestamp": ms(time.Hour), "last_seen": ms(time.Hour)},
+		"u4": map[string]interface{}{"room": 3.0},
+	}}
+	a.Store.PostState(&users)
+	a.events.publish(change{Op: "resync"})
+	for len(sub.C) > 0 {
+		<-sub.C
+	}
+
+	if err := a.expireUsers(now); err != nil {
+		t.Fatal(err)
+	}
+
+	var s state
+	s.StateID = usersStateID
+	a.Store.GetState(&s)
+	if len(s.Data) != 2 || s.Data["u2"] == nil || s.Data["u4"] == nil {
+		t.Errorf("Expected u2 and u4 to remain. Got %v", s.Data)
+	}
+
+	ops := map[string]int{}
+	for len(sub.C) > 0 {
+		ops[(<-sub.C).Op]++
+	}
+	if ops["userLeft"] != 2 || ops["roomClosed"] != 1 {
+		t.Errorf("Expected u1 and u3 to leave and room 2 to close. Got %v", ops)
+	}
+	if list := a.rooms.all(); len(list) != 2 || list[0].NumUsers != 1 {
+		t.Errorf("Expected rooms 1 and 3 with one user each. Got %v", list)
+	}
+
+	history, _ := a.Store.GetHistory(usersStateID, users.Rev, 0)
+	if len(history) != 2 || history[0].Op != "deleteStateJSON" || history[0].Key != "u1" || history[1].Key != "u3" || history[0].Client != presenceClient {
+		t.Errorf("Expected a key delete of u1 and u3 in the history. Got %v", history)
+	}
+
+	rev := s.Rev
+	if err := a.expireUsers(now); err != nil {
+		t.Fatal(err)
+	}
+	a.Store.GetState(&s)
+	if s.Rev != rev {
+		t.Errorf("Expected no write without stale users. Got rev %d after %d", s.Rev, rev)
+	}
+}
+
+// beatingStore sends a heartbeat of a user right before the first delete of
+// it, as if it raced with the sweep.
+type beatingStore struct {
+	Store
+	beat func(key string)
+}
+
+func (b *beatingStore) DeleteStateJSON(s *state, key string) error {
+	if b.beat != nil {
+		b.beat(key)
+		b.beat = nil
+	}
+
+	return b.Store.DeleteStateJSON(s, key)
+}
+
+func TestExpireUsersRacingHeartbeat(t *testing.T) {
+	a := newTestApp(t)
+	a.config.Presence.TTL = time.Minute
+
+	now := time.Now()
+	old := float64(now.Add(-time.Hour).UnixNano() / 1e6)
+	users := state{StateID: usersStateID, Tag: galaxyTag, Data: map[string]interface{}{
+		"u1": map[string]interface{}{"room": 1.0, "last_seen": old},
+		"u2": map[string]interface{}{"room": 1.0, "last_seen": old},
+	}}
+	a.Store.PostState(&users)
+
+	store := a.Store
+	a.Store = &beatingStore{Store: store, beat: func(key string) {
+		s := state{StateID: usersStateID, NoHistory: true}
+		store.PostStatePath(&s, "heartbeat", []string{key, "last_seen"}, float64(now.UnixNano()/1e6))
+	}}
+	if err := a.expireUsers(now); err != nil {
+		t.Fatal(err)
+	}
+
+	s := state{StateID: usersStateID}
+	store.GetState(&s)
+	if len(s.Data) != 1 || s.Data["u1"] == nil {
+		t.Errorf("Expected u1, seen while being expired, to remain. Got %v", s.Data)
+	}
+}
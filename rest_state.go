@@ -5,56 +5,102 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func (a *App) findState(w http.ResponseWriter, r *http.Request) {
-	key := r.FormValue("key")
-	value := r.FormValue("value")
+func (a *App) getStateByTag(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tag := vars["tag"]
 
-	states, err := findStates(a.DB, key, value)
+	wait, since, err := longPoll(r)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, states)
-}
-
-func (a *App) getStateByTag(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tag := vars["tag"]
-
-	states, err := getStateByTag(a.DB, tag)
+	// The version comes with the states so that a client waiting from it
+	// misses nothing.
+	states, version, err := a.tagStates(tag)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if wait > 0 {
+		if since == "" {
+			since = version
+		}
+		changed, err := a.waitForTag(w, r, tag, wait, since)
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !changed {
+			w.Header().Set("ETag", strconv.Quote(since))
+			respondNotModified(w)
+			return
+		}
+		if states, version, err = a.tagStates(tag); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
 
-	respondWithJSON(w, http.StatusOK, states)
+	respondConditional(w, r, strconv.Quote(version), time.Time{}, states)
 }
 
 func (a *App) getRooms(w http.ResponseWriter, r *http.Request) {
 
-	states, err := getRooms(a.DB)
+	if a.rooms != nil && a.rooms.current() {
+		respondConditional(w, r, "", time.Time{}, a.rooms.all())
+		return
+	}
+
+	states, err := a.Store.GetRooms()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, states)
+	respondConditional(w, r, "", time.Time{}, states)
 }
 
 func (a *App) getRoom(w http.ResponseWriter, r *http.Request) {
 	var i room
 	vars := mux.Vars(r)
-	id := vars["id"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid room id")
+		return
+	}
 
-	err := i.getRoom(a.DB, id)
+	if a.rooms != nil && a.rooms.current() {
+		var ok bool
+		if i, ok = a.rooms.get(id); !ok {
+			err = sql.ErrNoRows
+		}
+	} else {
+		err = a.Store.GetRoom(&i, id)
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Not Found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
@@ -63,13 +109,15 @@ func (a *App) getRoom(w http.ResponseWriter, r *http.Request) {
 
 func (a *App) getStates(w http.ResponseWriter, r *http.Request) {
 
-	states, err := getStates(a.DB)
+	states, err := a.Store.GetStates()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, states)
+	// No Last-Modified, deleting a state leaves the others' times as they
+	// were.
+	respondConditional(w, r, "", time.Time{}, states)
 }
 
 func (a *App) getState(w http.ResponseWriter, r *http.Request) {
@@ -77,27 +125,42 @@ func (a *App) getState(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	s.StateID = vars["id"]
 
-	if err := s.getState(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Not Found")
-		default:
+	wait, v, err := longPoll(r)
+	since, hasSince, serr := sinceRev(v)
+	if err != nil || serr != nil || (wait > 0 && r.FormValue("rev") != "") {
+		respondWithError(w, http.StatusBadRequest, errInvalidWait.Error())
+		return
+	}
+	if wait > 0 {
+		changed, err := a.waitForState(w, r, vars["tag"], s.StateID, wait, since, hasSince)
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !changed {
+			setETag(w, int(since))
+			respondNotModified(w)
+			return
 		}
-		return
 	}
 
-	respondWithJSON(w, http.StatusOK, s.Data)
-}
-
-func (a *App) getStateJSON(w http.ResponseWriter, r *http.Request) {
-	var s state
-	vars := mux.Vars(r)
-	s.Tag = vars["tag"]
-	s.StateID = vars["id"]
-	key := vars["jsonb"]
+	current := true
+	if v := r.FormValue("rev"); v != "" {
+		current = false
+		rev, perr := strconv.Atoi(v)
+		if perr != nil || rev < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid revision")
+			return
+		}
+		err = stateAt(a.Store, &s, rev)
+	} else {
+		err = a.Store.GetState(&s)
+	}
 
-	if err := s.getStateJSON(a.DB, key); err != nil {
+	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			respondWithError(w, http.StatusNotFound, "Not Found")
@@ -107,7 +170,17 @@ func (a *App) getStateJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, s.Data)
+	tag := ""
+	if s.Rev > 0 {
+		tag = etag(s.Rev)
+	}
+	// Past revisions keep the modification time of the current one.
+	var modified time.Time
+	if current {
+		modified = s.Updated
+	}
+
+	respondConditional(w, r, tag, modified, s.Data)
 }
 
 func (a *App) postState(w http.ResponseWriter, r *http.Request) {
@@ -115,6 +188,10 @@ func (a *App) postState(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	s.Tag = vars["tag"]
 	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	d := json.NewDecoder(r.Body)
 	if err := d.Decode(&s.Data); err != nil {
@@ -124,11 +201,14 @@ func (a *App) postState(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 
-	if err := s.postState(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.Store.PostState(&s); err != nil {
+		respondWithWriteError(w, err)
 		return
 	}
 
+	a.notify(r, s.Rev, "postState", "", s.Data)
+
+	setETag(w, s.Rev)
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
@@ -136,6 +216,10 @@ func (a *App) updateState(w http.ResponseWriter, r *http.Request) {
 	var s state
 	vars := mux.Vars(r)
 	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	d := json.NewDecoder(r.Body)
 	if err := d.Decode(&s.Data); err != nil {
@@ -145,11 +229,14 @@ func (a *App) updateState(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 
-	if err := s.updateState(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.Store.UpdateState(&s); err != nil {
+		respondWithWriteError(w, err)
 		return
 	}
 
+	a.notify(r, s.Rev, "updateState", "", s.Data)
+
+	setETag(w, s.Rev)
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
@@ -157,29 +244,110 @@ func (a *App) postStateValue(w http.ResponseWriter, r *http.Request) {
 	var s state
 	vars := mux.Vars(r)
 	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	key := vars["jsonb"]
+
+	value, err := typedValue(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.Store.PostStateValue(&s, value, key); err != nil {
+		respondWithWriteError(w, err)
+		return
+	}
+
+	a.notify(r, s.Rev, "postStateValue", key, value)
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// typedValue reads the scalar of a postStateValue request: the value field
+// converted to the type field. Without a type the legacy mapping applies, a
+// non-empty value is a boolean and otherwise the status field is stored as
+// a string.
+func typedValue(r *http.Request) (interface{}, error) {
 	value := r.FormValue("value")
-	status := r.FormValue("status")
+	typ := r.FormValue("type")
 
-	if value == "" {
-		if err := s.postStateValue(a.DB, status, key); err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
+	if typ == "" {
+		if value == "" {
+			return r.FormValue("status"), nil
 		}
-	} else {
-		if err := s.postStateStatus(a.DB, value, key); err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
+		typ = "bool"
+	}
+
+	switch typ {
+	case "string":
+		return value, nil
+	case "number":
+		n, err := parseNumber(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %q", value)
+		}
+		return n, nil
+	case "bool", "boolean":
+		b, ok := parseBool(value)
+		if !ok {
+			return nil, fmt.Errorf("Invalid boolean %q", value)
+		}
+		return b, nil
+	case "null":
+		if value != "" && value != "null" {
+			return nil, fmt.Errorf("Invalid null %q", value)
 		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Invalid type %q", typ)
 	}
+}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+// parseBool reads a boolean like a PostgreSQL bool cast, which the legacy
+// writes used: true, yes, on, 1 or false, no, off, 0, in any case and
+// with unique prefixes.
+func parseBool(v string) (bool, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" || v == "o" {
+		return false, false
+	}
+
+	for _, w := range []string{"true", "yes", "on", "1"} {
+		if strings.HasPrefix(w, v) {
+			return true, true
+		}
+	}
+	for _, w := range []string{"false", "no", "off", "0"} {
+		if strings.HasPrefix(w, v) {
+			return false, true
+		}
+	}
+
+	return false, false
+}
+
+// parseNumber parses a number that JSON can represent.
+func parseNumber(v string) (float64, error) {
+	n, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsInf(n, 0) || math.IsNaN(n)) {
+		err = strconv.ErrRange
+	}
+
+	return n, err
 }
 
 func (a *App) postStateJSON(w http.ResponseWriter, r *http.Request) {
 	var s state
 	vars := mux.Vars(r)
 	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	key := vars["jsonb"]
 	var value map[string]interface{}
 	d := json.NewDecoder(r.Body)
@@ -189,11 +357,68 @@ func (a *App) postStateJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.postStateJSON(a.DB, value, key); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.Store.PostStateJSON(&s, value, key); err != nil {
+		respondWithWriteError(w, err)
+		return
+	}
+
+	a.notify(r, s.Rev, "postStateJSON", key, value)
+
+	setETag(w, s.Rev)
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// patchState applies a JSON Patch or a JSON Merge Patch to a state.
+func (a *App) patchState(w http.ResponseWriter, r *http.Request) {
+	var s state
+	vars := mux.Vars(r)
+	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+		return
+	}
+
+	var fn modifier
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/json-patch+json":
+		ops, err := parseJSONPatch(body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		fn = func(data map[string]interface{}) (map[string]interface{}, error) {
+			return applyJSONPatch(data, ops)
+		}
+	case "application/merge-patch+json":
+		var patch map[string]interface{}
+		if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid merge patch, an object is required")
+			return
+		}
+		fn = func(data map[string]interface{}) (map[string]interface{}, error) {
+			return mergePatch(data, patch).(map[string]interface{}), nil
+		}
+	default:
+		w.Header().Set("Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported patch format")
+		return
+	}
+
+	if err := a.Store.ModifyState(&s, "patchState", fn); err != nil {
+		respondWithWriteError(w, err)
 		return
 	}
 
+	a.notify(r, s.Rev, "patchState", "", s.Data)
+
+	setETag(w, s.Rev)
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
@@ -201,12 +426,18 @@ func (a *App) deleteState(w http.ResponseWriter, r *http.Request) {
 	var s state
 	vars := mux.Vars(r)
 	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if err := s.deleteState(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.Store.DeleteState(&s); err != nil {
+		respondWithWriteError(w, err)
 		return
 	}
 
+	a.notify(r, s.Rev, "deleteState", "", nil)
+
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
@@ -214,12 +445,98 @@ func (a *App) deleteStateJSON(w http.ResponseWriter, r *http.Request) {
 	var s state
 	vars := mux.Vars(r)
 	s.StateID = vars["id"]
+	if err := prepareWrite(r, &s); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	value := vars["jsonb"]
 
-	if err := s.deleteStateJSON(a.DB, value); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.Store.DeleteStateJSON(&s, value); err != nil {
+		respondWithWriteError(w, err)
 		return
 	}
 
+	a.notify(r, s.Rev, "deleteStateJSON", value, nil)
+
+	setETag(w, s.Rev)
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
+
+// historyLimit is the number of revisions a history request returns without
+// a limit, the latest ones.
+const historyLimit = 100
+
+func (a *App) getStateHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	after := 0
+	if v := r.FormValue("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid revision")
+			return
+		}
+		after = n
+	}
+
+	limit := historyLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	history, err := a.Store.GetHistory(vars["id"], after, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// clientID identifies the writer for the state history: the X-Client-ID
+// header when given, otherwise the client address. Both headers are taken
+// as the client sends them, X-Forwarded-For is only the address of the
+// client behind a proxy that sets it. The id labels the history entries, it
+// is not an authentication.
+func clientID(r *http.Request) string {
+	if id := r.Header.Get("X-Client-ID"); id != "" {
+		return id
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+func (a *App) notify(r *http.Request, rev int, op string, key string, value interface{}) {
+	vars := mux.Vars(r)
+	a.broadcast(change{
+		Op:      op,
+		Tag:     vars["tag"],
+		StateID: vars["id"],
+		Key:     key,
+		Value:   value,
+		Rev:     rev,
+	})
+}
+
+// broadcast delivers a change of a write of this instance. A write that
+// left a missing state missing took no revision and changed nothing.
+func (a *App) broadcast(c change) {
+	if c.Rev == 0 {
+		return
+	}
+	if a.rooms != nil {
+		a.rooms.wrote(c)
+	}
+	a.broadcaster.broadcast(c)
+}
@@ -0,0 +1,330 @@
+// rooms.go
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	galaxyTag = "galaxy"
+	// usersStateID is the state holding the galaxy users by user id.
+	usersStateID = "users"
+	// Room events are published as changes of the galaxy rooms state.
+	roomsStateID = "rooms"
+)
+
+// roomsView is the rooms projection of the galaxy users state. It follows
+// the changes of the users state published to the hub, so writes of every
+// instance reach it, and updates only the rooms a change touches.
+//
+// The room events, roomOpened, roomClosed, userJoined, userLeft and
+// questionRaised, are derived by every instance from the same changes and
+// so are published to the local hub only. Their key is the room id, or the
+// JSON Pointer /<room>/<user> for the events of a user.
+type roomsView struct {
+	store  Store
+	events *hub
+
+	// reads serializes reading the store with applying what was read. A
+	// change is only a hint of what to read again, so however the observers
+	// of concurrent writes interleave the view ends with the last read.
+	reads sync.Mutex
+
+	mu     sync.RWMutex
+	users  map[string]map[string]interface{}
+	byRoom map[int]map[string]bool
+	rooms  map[int]*room
+	stamps map[int]float64
+	// list is the ordered rooms, nil after a change.
+	list []room
+	// seen is the last revision of the users state the view read, written
+	// the last one this instance wrote. The view is behind until its
+	// notification arrives.
+	seen    int
+	written int
+}
+
+func newRoomsView(store Store, events *hub) *roomsView {
+	v := &roomsView{
+		store:  store,
+		events: events,
+		users:  make(map[string]map[string]interface{}),
+		byRoom: make(map[int]map[string]bool),
+		rooms:  make(map[int]*room),
+		stamps: make(map[int]float64),
+	}
+
+	// Observing first, the changes committed during the load are read again
+	// rather than lost.
+	events.observe(v.apply)
+	v.apply(change{Op: "resync"})
+
+	return v
+}
+
+// apply reads the user a change is about again, or the whole users state
+// after a change without a key, and updates the view with it.
+func (v *roomsView) apply(c change) {
+	if c.Op != "resync" && c.StateID != usersStateID {
+		return
+	}
+
+	var events []change
+	var err error
+	if c.Op == "resync" || c.Key == "" {
+		events, err = v.reload()
+	} else {
+		events, err = v.refresh(keyPointer(c.Key)[0])
+	}
+	if err != nil {
+		log.Printf("rooms: %v", err)
+	} else {
+		v.caughtUp(c.Rev)
+	}
+	v.publish(events)
+}
+
+// wrote records a write of the users state by this instance.
+func (v *roomsView) wrote(c change) {
+	if c.StateID != usersStateID {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if c.Rev > v.written {
+		v.written = c.Rev
+	}
+}
+
+func (v *roomsView) caughtUp(rev int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if rev > v.seen {
+		v.seen = rev
+	}
+}
+
+// current tells whether the view holds every write of this instance, the
+// rooms are read from the store otherwise.
+func (v *roomsView) current() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	return v.seen >= v.written
+}
+
+// reload reads the users state and applies the differences to the view.
+func (v *roomsView) reload() ([]change, error) {
+	v.reads.Lock()
+	defer v.reads.Unlock()
+
+	s := state{StateID: usersStateID}
+	err := v.store.GetState(&s)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	v.caughtUp(s.Rev)
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.users))
+	for k := range v.users {
+		if _, ok := s.Data[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	v.mu.RUnlock()
+
+	events := []change{}
+	for _, k := range keys {
+		events = append(events, v.set(k, nil)...)
+	}
+	for _, k := range jsonbKeys(s.Data) {
+		events = append(events, v.set(k, s.Data[k])...)
+	}
+
+	return events, nil
+}
+
+// refresh reads the entry of one user again.
+func (v *roomsView) refresh(key string) ([]change, error) {
+	v.reads.Lock()
+	defer v.reads.Unlock()
+
+	value, err := v.store.GetStatePath(&state{StateID: usersStateID}, []string{key})
+	if err == sql.ErrNoRows || err == errPathNotFound {
+		value, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return v.set(key, value), nil
+}
+
+// set replaces the entry of a user, nil or a value that is not an object
+// removing it, and returns the room events of the replacement.
+func (v *roomsView) set(key string, value interface{}) []change {
+	u, _ := value.(map[string]interface{})
+	if u != nil {
+		u = cloneMap(u)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	old, had := v.users[key]
+	if reflect.DeepEqual(old, u) && had == (u != nil) {
+		return nil
+	}
+	oldRoom, inOld := roomOf(old)
+	newRoom, inNew := roomOf(u)
+
+	if u == nil {
+		delete(v.users, key)
+	} else {
+		v.users[key] = u
+	}
+
+	events := []change{}
+	if inOld && (!inNew || oldRoom != newRoom) {
+		delete(v.byRoom[oldRoom], key)
+		v.update(oldRoom)
+		events = append(events, roomEvent("userLeft", oldRoom, key, nil))
+		if _, open := v.rooms[oldRoom]; !open {
+			events = append(events, roomEvent("roomClosed", oldRoom, "", nil))
+		}
+	}
+	if inNew && (!inOld || oldRoom != newRoom) {
+		if v.byRoom[newRoom] == nil {
+			v.byRoom[newRoom] = make(map[string]bool)
+		}
+		v.byRoom[newRoom][key] = true
+		_, open := v.rooms[newRoom]
+		v.update(newRoom)
+		if !open {
+			events = append(events, roomEvent("roomOpened", newRoom, "", *v.rooms[newRoom]))
+		}
+		events = append(events, roomEvent("userJoined", newRoom, key, u))
+	} else if inNew {
+		v.update(newRoom)
+	}
+	if q, _ := u["question"].(bool); q && inNew {
+		if had, _ := old["question"].(bool); !had || oldRoom != newRoom {
+			events = append(events, roomEvent("questionRaised", newRoom, key, u))
+		}
+	}
+	v.list = nil
+
+	return events
+}
+
+func roomOf(u map[string]interface{}) (int, bool) {
+	if u == nil {
+		return 0, false
+	}
+
+	return roomID(u)
+}
+
+// update rebuilds a room from its users. The caller holds the lock.
+func (v *roomsView) update(id int) {
+	keys := make([]string, 0, len(v.byRoom[id]))
+	for k := range v.byRoom[id] {
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		delete(v.byRoom, id)
+		delete(v.rooms, id)
+		delete(v.stamps, id)
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return jsonbLess(keys[i], keys[j]) })
+
+	users := make([]map[string]interface{}, len(keys))
+	for i, k := range keys {
+		users[i] = v.users[k]
+	}
+	r := aggregateRooms(users)[0]
+	v.rooms[id] = &r
+	v.stamps[id], _ = firstUser(users)["timestamp"].(float64)
+}
+
+// firstUser is the user describing a room, the earliest by timestamp.
+func firstUser(users []map[string]interface{}) map[string]interface{} {
+	first := users[0]
+	stamp, _ := first["timestamp"].(float64)
+	for _, u := range users[1:] {
+		if st, _ := u["timestamp"].(float64); st < stamp {
+			first, stamp = u, st
+		}
+	}
+
+	return first
+}
+
+func roomEvent(op string, id int, user string, value interface{}) change {
+	key := strconv.Itoa(id)
+	if user != "" {
+		key = formatPointer([]string{key, user})
+	}
+
+	return change{Op: op, Tag: galaxyTag, StateID: roomsStateID, Key: key, Value: value}
+}
+
+func (v *roomsView) publish(events []change) {
+	for _, c := range events {
+		v.events.publish(c)
+	}
+}
+
+// all returns the rooms ordered like GetRooms. The result is shared and
+// must not be modified.
+func (v *roomsView) all() []room {
+	v.mu.RLock()
+	list := v.list
+	v.mu.RUnlock()
+	if list != nil {
+		return list
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.list == nil {
+		list := make([]room, 0, len(v.rooms))
+		for _, r := range v.rooms {
+			list = append(list, *r)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			si, sj := v.stamps[list[i].Room], v.stamps[list[j].Room]
+			if si != sj {
+				return si < sj
+			}
+			return list[i].Room < list[j].Room
+		})
+		v.list = list
+	}
+
+	return v.list
+}
+
+func (v *roomsView) get(id int) (room, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	r, ok := v.rooms[id]
+	if !ok {
+		return room{}, false
+	}
+
+	return *r, true
+}
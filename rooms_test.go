@@ -0,0 +1,220 @@
+// rooms_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestGetRoom(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/galaxy/users", `{"u1":{"room":1234,"janus":"gxy1","group":"g1","question":true,"timestamp":2},"u2":{"room":2},"u3":{"room":1234,"janus":"gxy2","group":"g2","timestamp":1}}`, nil)
+
+	rr := executeTestRequest(a, "GET", "/galaxy/room/1234", "", nil)
+	var r room
+	json.Unmarshal(rr.Body.Bytes(), &r)
+	if rr.Code != http.StatusOK || r.Room != 1234 || r.Janus != "gxy2" || r.NumUsers != 2 || !r.Questions {
+		t.Errorf("Expected room 1234 described by its earliest user. Got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// The store describes the room like the rooms view.
+	var stored room
+	if err := a.Store.GetRoom(&stored, 1234); err != nil || stored.Janus != r.Janus || stored.Group != r.Group || stored.NumUsers != r.NumUsers {
+		t.Errorf("Expected the stored room to match %v. Got %v %v", r, stored, err)
+	}
+
+	for url, code := range map[string]int{
+		"/galaxy/room/abc":  http.StatusBadRequest,
+		"/galaxy/room/12.5": http.StatusBadRequest,
+		"/galaxy/room/0":    http.StatusNotFound,
+		"/galaxy/room/99":   http.StatusNotFound,
+	} {
+		if rr := executeTestRequest(a, "GET", url, "", nil); rr.Code != code {
+			t.Errorf("%s: expected %d. Got %d", url, code, rr.Code)
+		}
+	}
+}
+
+func benchmarkUsers(rooms, perRoom int) []map[string]interface{} {
+	data := make(map[string]interface{})
+	for i := 0; i < rooms*perRoom; i++ {
+		data[fmt.Sprintf("user-%d", i)] = map[string]interface{}{
+			"room":      float64(i % rooms),
+			"janus":     "gxy1",
+			"group":     fmt.Sprintf("group %d", i%rooms),
+			"timestamp": float64(i),
+			"question":  i%7 == 0,
+		}
+	}
+
+	return galaxyUsers(data)
+}
+
+// BenchmarkAggregateRooms lists 500 rooms of 10 users in one pass.
+func BenchmarkAggregateRooms(b *testing.B) {
+	users := benchmarkUsers(500, 10)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		aggregateRooms(users)
+	}
+}
+
+// BenchmarkRoomLookups lists the same rooms with a scan of the users per
+// room, the way the rooms used to be listed.
+func BenchmarkRoomLookups(b *testing.B) {
+	users := benchmarkUsers(500, 10)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for id := 0; id < 500; id++ {
+			findRoom(users, id)
+		}
+	}
+}
+
+func TestRoomsView(t *testing.T) {
+	a := newTestApp(t)
+	sub := a.events.subscribe(topic{StateID: roomsStateID})
+	defer a.events.unsubscribe(sub)
+
+	expect := func(ops ...string) {
+		t.Helper()
+		for _, op := range ops {
+			select {
+			case c := <-sub.C:
+				if c.Op != op {
+					t.Errorf("Expected %s. Got %s %s", op, c.Op, c.Key)
+				}
+			default:
+				t.Errorf("Expected %s. Got nothing", op)
+			}
+		}
+		select {
+		case c := <-sub.C:
+			t.Errorf("Expected no more events. Got %s %s", c.Op, c.Key)
+		default:
+		}
+	}
+	rooms := func() []room {
+		var list []room
+		rr := executeTestRequest(a, "GET", "/galaxy/rooms", "", nil)
+		json.Unmarshal(rr.Body.Bytes(), &list)
+		return list
+	}
+
+	// Writes to a missing users state change nothing.
+	executeTestRequest(a, "PUT", "/galaxy/users/u1", `{"room":7}`, nil)
+	expect()
+	if list := rooms(); len(list) != 0 {
+		t.Errorf("Expected no rooms without a users state. Got %v", list)
+	}
+
+	executeTestRequest(a, "PUT", "/galaxy/users", `{}`, nil)
+	executeTestRequest(a, "PUT", "/galaxy/users/u1", `{"room":1,"janus":"gxy1","timestamp":5}`, nil)
+	expect("roomOpened", "userJoined")
+	executeTestRequest(a, "PUT", "/galaxy/users/u2", `{"room":1,"janus":"gxy2","timestamp":3,"question":true}`, nil)
+	expect("userJoined", "questionRaised")
+	executeTestRequest(a, "PUT", "/galaxy/users/u3", `{"room":2,"timestamp":4}`, nil)
+	expect("roomOpened", "userJoined")
+
+	list := rooms()
+	if len(list) != 2 || list[0].Room != 1 || list[0].Janus != "gxy2" || list[0].NumUsers != 2 || !list[0].Questions || list[1].Room != 2 {
+		t.Errorf("Expected rooms 1 and 2. Got %v", list)
+	}
+
+	executeTestRequest(a, "PUT", "/galaxy/users/u3", `{"room":1,"timestamp":6}`, nil)
+	expect("userLeft", "roomClosed", "userJoined")
+	executeTestRequest(a, "DELETE", "/galaxy/users/u2", "", nil)
+	expect("userLeft")
+
+	rr := executeTestRequest(a, "GET", "/galaxy/room/1", "", nil)
+	var r room
+	json.Unmarshal(rr.Body.Bytes(), &r)
+	if r.NumUsers != 2 || r.Janus != "gxy1" || r.Questions {
+		t.Errorf("Expected room 1 with u1 and u3. Got %s", rr.Body.String())
+	}
+
+	// The value of a change is not trusted, the user is read again.
+	a.events.publish(change{Op: "postStateJSON", StateID: usersStateID, Key: "u1", Value: map[string]interface{}{"room": 9.0}})
+	expect()
+	if _, ok := a.rooms.get(9); ok {
+		t.Errorf("Expected the view to follow the store, not the change")
+	}
+
+	// Other writes of the users state reload it.
+	executeTestRequest(a, "PUT", "/galaxy/users", `{"u4":{"room":7}}`, nil)
+	expect("userLeft", "userLeft", "roomClosed", "roomOpened", "userJoined")
+	if list := rooms(); len(list) != 1 || list[0].Room != 7 {
+		t.Errorf("Expected room 7. Got %v", list)
+	}
+}
+
+func TestRoomsViewConcurrentWrites(t *testing.T) {
+	a := newTestApp(t)
+	executeTestRequest(a, "PUT", "/galaxy/users", `{}`, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				executeTestRequest(a, "PUT", "/galaxy/users/u1", fmt.Sprintf(`{"room":%d}`, i*20+j+1), nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	u, _ := a.Store.GetStatePath(&state{StateID: usersStateID}, []string{"u1"})
+	id, _ := roomID(u.(map[string]interface{}))
+	if list := a.rooms.all(); len(list) != 1 || list[0].Room != id {
+		t.Errorf("Expected only room %d of the stored user. Got %v", id, list)
+	}
+}
+
+// laggingBroadcaster holds the changes back like a notification on its way.
+type laggingBroadcaster struct {
+	held []change
+}
+
+func (l *laggingBroadcaster) broadcast(c change) {
+	l.held = append(l.held, c)
+}
+
+func TestRoomsViewReadYourWrites(t *testing.T) {
+	a := newTestApp(t)
+	executeTestRequest(a, "PUT", "/galaxy/users", `{"u1":{"room":1}}`, nil)
+	lag := &laggingBroadcaster{}
+	a.broadcaster = lag
+
+	executeTestRequest(a, "PUT", "/galaxy/users/u2", `{"room":2}`, nil)
+	if _, ok := a.rooms.get(2); ok {
+		t.Fatalf("Expected the view to miss room 2")
+	}
+	rr := executeTestRequest(a, "GET", "/galaxy/room/2", "", nil)
+	var list []room
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected room 2 from the store. Got %d", rr.Code)
+	}
+	rr = executeTestRequest(a, "GET", "/galaxy/rooms", "", nil)
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list) != 2 {
+		t.Errorf("Expected rooms 1 and 2 from the store. Got %s", rr.Body.String())
+	}
+
+	for _, c := range lag.held {
+		a.events.publish(c)
+	}
+	if !a.rooms.current() {
+		t.Errorf("Expected the view to catch up with the notification")
+	}
+	if _, ok := a.rooms.get(2); !ok {
+		t.Errorf("Expected the view to hold room 2")
+	}
+}
@@ -0,0 +1,157 @@
+// search.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errInvalidSearch = errors.New("Invalid search")
+
+// search selects the states under Tag, any tag when empty, whose data
+// contains every document of Contains like the jsonb @> operator.
+type search struct {
+	Tag      string
+	Contains []interface{}
+}
+
+func filterStates(states []state, q search) []state {
+	found := []state{}
+	for _, s := range states {
+		if q.matches(s) {
+			found = append(found, s)
+		}
+	}
+
+	return found
+}
+
+func (q search) matches(s state) bool {
+	if q.Tag != "" && q.Tag != s.Tag {
+		return false
+	}
+	for _, c := range q.Contains {
+		if !jsonContains(s.Data, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// searchBody is the body of POST /_search. Where maps JSON Pointers
+// to the values expected there, Contains is a document or a list of
+// documents the data must contain.
+type searchBody struct {
+	Tag      string                 `json:"tag"`
+	Where    map[string]interface{} `json:"where"`
+	Contains json.RawMessage        `json:"contains"`
+}
+
+type searchResult struct {
+	StateID string                 `json:"state_id"`
+	Tag     string                 `json:"tag"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+// condition turns a path and a value into the document containing it. Paths
+// go through objects only.
+func condition(path []string, value interface{}) interface{} {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]interface{}{path[i]: value}
+	}
+
+	return value
+}
+
+// parseSearch reads a search from the query, ?tag, ?key and ?value for a
+// top-level string and any number of ?where=<JSON Pointer>=<value>, or from
+// a JSON body. Values that are not JSON are strings.
+func parseSearch(r *http.Request) (search, error) {
+	q := search{Tag: r.FormValue("tag"), Contains: []interface{}{}}
+
+	if key := r.FormValue("key"); key != "" {
+		q.Contains = append(q.Contains, condition([]string{key}, r.FormValue("value")))
+	}
+
+	for _, w := range r.Form["where"] {
+		i := strings.Index(w, "=")
+		if i < 0 {
+			return q, errInvalidSearch
+		}
+		path, err := parsePointer(w[:i])
+		if err != nil || len(path) == 0 {
+			return q, errInvalidSearch
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(w[i+1:]), &v); err != nil {
+			v = w[i+1:]
+		}
+		q.Contains = append(q.Contains, condition(path, v))
+	}
+
+	if r.Method != "POST" {
+		return q, nil
+	}
+
+	var body searchBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err == io.EOF {
+		return q, nil
+	} else if err != nil {
+		return q, errInvalidSearch
+	}
+	if body.Tag != "" {
+		q.Tag = body.Tag
+	}
+	for p, v := range body.Where {
+		path, err := parsePointer(p)
+		if err != nil || len(path) == 0 {
+			return q, errInvalidSearch
+		}
+		q.Contains = append(q.Contains, condition(path, v))
+	}
+	if body.Contains != nil {
+		var c interface{}
+		json.Unmarshal(body.Contains, &c)
+		switch c := c.(type) {
+		case map[string]interface{}:
+			q.Contains = append(q.Contains, c)
+		case []interface{}:
+			for _, e := range c {
+				if _, ok := e.(map[string]interface{}); !ok {
+					return q, errInvalidSearch
+				}
+				q.Contains = append(q.Contains, e)
+			}
+		default:
+			return q, errInvalidSearch
+		}
+	}
+
+	return q, nil
+}
+
+func (a *App) findState(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearch(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	states, err := a.Store.FindStates(q)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	results := make([]searchResult, len(states))
+	for i, s := range states {
+		results[i] = searchResult{StateID: s.StateID, Tag: s.Tag, Data: s.Data}
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
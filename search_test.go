@@ -0,0 +1,76 @@
+// search_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestFindState(t *testing.T) {
+	a := newTestApp(t)
+
+	executeTestRequest(a, "PUT", "/galaxy/users", `{"u1":{"room":1,"question":true},"u2":{"room":2}}`, nil)
+	executeTestRequest(a, "PUT", "/galaxy/room", `{"name":"main","count":2,"tags":["a","b"]}`, nil)
+	executeTestRequest(a, "PUT", "/other/hall", `{"name":"main","count":3}`, nil)
+
+	tests := []struct {
+		method, query, body string
+		want                []string
+	}{
+		{"GET", "key=name&value=main", "", []string{"room", "hall"}},
+		{"GET", "key=name&value=main&tag=other", "", []string{"hall"}},
+		{"GET", "where=" + url.QueryEscape("/count=2"), "", []string{"room"}},
+		{"GET", "where=" + url.QueryEscape("/u1/question=true") + "&where=" + url.QueryEscape("/u2/room=2"), "", []string{"users"}},
+		{"GET", "where=" + url.QueryEscape("/u1/question=false"), "", []string{}},
+		{"GET", "where=" + url.QueryEscape(`/count="2"`), "", []string{}},
+		{"POST", "", `{"tag":"galaxy","where":{"/name":"main"}}`, []string{"room"}},
+		{"POST", "", `{"contains":{"tags":["b"]}}`, []string{"room"}},
+		{"POST", "", `{"contains":[{"u1":{"room":1}},{"u2":{}}]}`, []string{"users"}},
+		{"POST", "tag=galaxy", ``, []string{"users", "room"}},
+	}
+
+	for _, tt := range tests {
+		rr := executeTestRequest(a, tt.method, "/_search?"+tt.query, tt.body, nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s %s %s: expected 200. Got %d %s", tt.method, tt.query, tt.body, rr.Code, rr.Body.String())
+			continue
+		}
+		var results []searchResult
+		json.Unmarshal(rr.Body.Bytes(), &results)
+		ids := []string{}
+		for _, r := range results {
+			ids = append(ids, r.StateID)
+		}
+		if len(ids) != len(tt.want) {
+			t.Errorf("%s %s %s: expected %v. Got %v", tt.method, tt.query, tt.body, tt.want, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.want[i] {
+				t.Errorf("%s %s %s: expected %v. Got %v", tt.method, tt.query, tt.body, tt.want, ids)
+				break
+			}
+		}
+	}
+
+	for _, bad := range []struct{ method, query, body string }{
+		{"GET", "where=count", ""},
+		{"GET", "where=" + url.QueryEscape("count=1"), ""},
+		{"POST", "", `{"contains":1}`},
+		{"POST", "", `{`},
+	} {
+		rr := executeTestRequest(a, bad.method, "/_search?"+bad.query, bad.body, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s %s %s: expected 400. Got %d", bad.method, bad.query, bad.body, rr.Code)
+		}
+	}
+
+	// The search lives under /_search, a state may be called search.
+	executeTestRequest(a, "PUT", "/states/search", `{"a":1}`, nil)
+	if rr := executeTestRequest(a, "GET", "/states/search", "", nil); rr.Code != http.StatusOK || rr.Body.String() != `{"a":1}` {
+		t.Errorf("Expected the state search. Got %d %s", rr.Code, rr.Body.String())
+	}
+}
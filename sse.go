@@ -0,0 +1,160 @@
+// sse.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const sseHeartbeat = 15 * time.Second
+
+// streamEvents sends the changes of a state, or of every state under a tag,
+// as Server-Sent Events. Reconnecting clients get the changes they missed
+// through the Last-Event-ID header, see eventID.
+func (a *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	vars := mux.Vars(r)
+	t := topic{Tag: vars["tag"], StateID: vars["id"], Key: r.FormValue("key")}
+
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.FormValue("last_event_id")
+	}
+	since, rev := parseEventID(last)
+
+	var sub *subscription
+	var replay []change
+	if t.StateID != "" && rev > 0 && !a.events.covers(since) {
+		// The ID is of another instance or from before a restart, the
+		// history of the state has what was missed.
+		sub = a.events.subscribe(t)
+		var err error
+		if replay, rev, err = a.missedChanges(t, rev); err != nil {
+			a.events.unsubscribe(sub)
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		sub = a.events.subscribeSince(since, t)
+	}
+	defer a.events.unsubscribe(sub)
+
+	// Streams outlive any configured write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, c := range replay {
+		writeEvent(w, c)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case c, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			// Changes of the state already sent from the history.
+			if t.StateID != "" && c.StateID == t.StateID && c.Rev > 0 && c.Rev <= rev {
+				continue
+			}
+			writeEvent(w, c)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, c change) {
+	data, _ := json.Marshal(c)
+	fmt.Fprintf(w, "id: %s\ndata: %s\n\n", eventID(c), data)
+}
+
+// eventID is the SSE id of a change, its hub ID followed for the change of
+// a stored state by the revision: <id>.<rev>. The hub ID resumes a stream
+// on the same instance, the revision a stream of one state on any.
+func eventID(c change) string {
+	id := strconv.FormatUint(c.ID, 10)
+	if c.Rev > 0 {
+		id += "." + strconv.Itoa(c.Rev)
+	}
+
+	return id
+}
+
+func parseEventID(s string) (uint64, int) {
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		id, _ := strconv.ParseUint(s, 10, 64)
+		return id, 0
+	}
+
+	id, _ := strconv.ParseUint(s[:i], 10, 64)
+	rev, _ := strconv.Atoi(s[i+1:])
+
+	return id, rev
+}
+
+// missedChanges rebuilds the changes of the state of t after revision rev
+// from its history, with the revision they lead to. Without the whole
+// history since rev, like after writes left out of it, the client gets a
+// resync instead.
+func (a *App) missedChanges(t topic, rev int) ([]change, int, error) {
+	s := state{StateID: t.StateID}
+	if err := a.Store.GetState(&s); err != nil && err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+	history, err := a.Store.GetHistory(t.StateID, rev, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cur := s.Rev
+	if n := len(history); n > 0 && history[n-1].Rev > cur {
+		cur = history[n-1].Rev
+	}
+	resync := []change{{ID: a.events.lastID(), Op: "resync"}}
+	if cur < rev || len(history) != cur-rev {
+		return resync, cur, nil
+	}
+
+	changes := []change{}
+	for i, h := range history {
+		if h.Rev != rev+1+i {
+			return resync, cur, nil
+		}
+		c := change{Op: h.Op, Tag: t.Tag, StateID: t.StateID, Key: h.Key, Rev: h.Rev}
+		if h.NewValue != nil {
+			json.Unmarshal(h.NewValue, &c.Value)
+		}
+		if t.matches(c) {
+			changes = append(changes, t.project(c))
+		}
+	}
+
+	return changes, cur, nil
+}
@@ -0,0 +1,466 @@
+// store_memory.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mu       sync.RWMutex
+	states   map[string]*state
+	history  map[string][]revision
+	lastID   int
+	snapshot string
+}
+
+type memorySnapshot struct {
+	States  []state               `json:"states"`
+	History map[string][]revision `json:"history"`
+}
+
+func newMemoryStore(snapshot string) (*memoryStore, error) {
+	m := &memoryStore{
+		states:   make(map[string]*state),
+		history:  make(map[string][]revision),
+		snapshot: snapshot,
+	}
+
+	if snapshot == "" {
+		return m, nil
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *memoryStore) load() error {
+	b, err := ioutil.ReadFile(m.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap memorySnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		// Snapshots used to hold only the list of states.
+		if err := json.Unmarshal(b, &snap.States); err != nil {
+			return err
+		}
+	}
+
+	if snap.History != nil {
+		m.history = snap.History
+	}
+
+	for i := range snap.States {
+		s := snap.States[i]
+		if s.Data == nil {
+			s.Data = make(map[string]interface{})
+		}
+		m.states[s.StateID] = &s
+		if s.ID > m.lastID {
+			m.lastID = s.ID
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStore) save() error {
+	m.mu.RLock()
+	b, err := json.Marshal(memorySnapshot{States: m.sorted(), History: m.history})
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := m.snapshot + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.snapshot)
+}
+
+func (m *memoryStore) Close() error {
+	if m.snapshot == "" {
+		return nil
+	}
+
+	return m.save()
+}
+
+// sorted returns the states ordered by id, the caller must hold the lock.
+func (m *memoryStore) sorted() []state {
+	states := make([]state, 0, len(m.states))
+	for _, s := range m.states {
+		states = append(states, *s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+
+	return states
+}
+
+func (m *memoryStore) GetStates() ([]state, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	states := m.sorted()
+	for i := range states {
+		states[i].Data = cloneMap(states[i].Data)
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].Tag < states[j].Tag })
+
+	return states, nil
+}
+
+func (m *memoryStore) GetStateByTag(tag string) (map[string]interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	states := make(map[string]interface{})
+	for id, s := range m.states {
+		if s.Tag == tag {
+			states[id] = cloneMap(s.Data)
+		}
+	}
+
+	return states, nil
+}
+
+func (m *memoryStore) FindStates(q search) ([]state, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	states := []state{}
+	for _, s := range m.sorted() {
+		if q.matches(s) {
+			s.Data = cloneMap(s.Data)
+			states = append(states, s)
+		}
+	}
+
+	return states, nil
+}
+
+func (m *memoryStore) GetState(s *state) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	st, ok := m.states[s.StateID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.Data = cloneMap(st.Data)
+	s.Rev = st.Rev
+	s.Created = st.Created
+	s.Updated = st.Updated
+
+	return nil
+}
+
+// write replaces the state with what fn returns and records the change in
+// the history. fn gets a copy of the current state, nil when it does not
+// exist, and returns nil to remove it.
+func (m *memoryStore) write(s *state, op, key string, fn func(cur *state) (*state, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.states[s.StateID]
+	if old != nil {
+		if err := s.Cond.check(true, old.Rev); err != nil {
+			return err
+		}
+	} else if err := s.Cond.check(false, 0); err != nil {
+		return err
+	}
+
+	var cur *state
+	if old != nil {
+		c := *old
+		c.Data = cloneMap(old.Data)
+		cur = &c
+	}
+
+	next, err := fn(cur)
+	if err != nil {
+		return err
+	}
+	if old == nil && next == nil {
+		return nil
+	}
+
+	rev := 1
+	if old != nil {
+		rev = old.Rev + 1
+	} else if h := m.history[s.StateID]; len(h) > 0 {
+		rev = h[len(h)-1].Rev + 1
+	}
+
+	now := time.Now().UTC()
+	if next == nil {
+		delete(m.states, s.StateID)
+	} else {
+		if next.Created.IsZero() {
+			next.Created = now
+		}
+		next.Rev = rev
+		next.Updated = now
+		m.states[s.StateID] = next
+	}
+
+	if !s.NoHistory {
+		m.history[s.StateID] = append(m.history[s.StateID], revision{
+			StateID:  s.StateID,
+			Rev:      rev,
+			Op:       op,
+			Key:      key,
+			OldValue: memoryValue(old, key),
+			NewValue: memoryValue(next, key),
+			Client:   s.Client,
+			Time:     now,
+		})
+	}
+	s.Rev = rev
+
+	return nil
+}
+
+func memoryValue(st *state, key string) json.RawMessage {
+	if st == nil {
+		return nil
+	}
+	if key == "" {
+		b, _ := json.Marshal(st.Data)
+		return b
+	}
+	v, ok := keyValue(st.Data, key)
+	if !ok {
+		return nil
+	}
+	b, _ := json.Marshal(v)
+
+	return b
+}
+
+func (m *memoryStore) PostState(s *state) error {
+	return m.write(s, "postState", "", func(cur *state) (*state, error) {
+		if cur != nil {
+			cur.Data = cloneMap(s.Data)
+			s.ID = cur.ID
+			return cur, nil
+		}
+
+		m.lastID++
+		s.ID = m.lastID
+		return &state{
+			ID:      s.ID,
+			StateID: s.StateID,
+			Data:    cloneMap(s.Data),
+			Tag:     s.Tag,
+		}, nil
+	})
+}
+
+func (m *memoryStore) UpdateState(s *state) error {
+	return m.write(s, "updateState", "", func(cur *state) (*state, error) {
+		if cur != nil {
+			cur.Data = cloneMap(s.Data)
+		}
+		return cur, nil
+	})
+}
+
+func (m *memoryStore) PostStateValue(s *state, value interface{}, key string) error {
+	return m.setKey(s, "postStateValue", key, value)
+}
+
+func (m *memoryStore) PostStateJSON(s *state, value interface{}, key string) error {
+	return m.setKey(s, "postStateJSON", key, cloneJSON(value))
+}
+
+func (m *memoryStore) ModifyState(s *state, op string, fn modifier) error {
+	return m.modify(s, op, "", fn)
+}
+
+func (m *memoryStore) modify(s *state, op, key string, fn modifier) error {
+	return m.write(s, op, key, func(cur *state) (*state, error) {
+		if cur == nil {
+			return nil, sql.ErrNoRows
+		}
+		data, err := fn(cur.Data)
+		if err != nil {
+			return nil, err
+		}
+		cur.Data = data
+		s.Data = cloneMap(data)
+		return cur, nil
+	})
+}
+
+func (m *memoryStore) GetStatePath(s *state, path []string) (interface{}, error) {
+	if err := m.GetState(s); err != nil {
+		return nil, err
+	}
+
+	return pathGet(s.Data, path)
+}
+
+func (m *memoryStore) PostStatePath(s *state, op string, path []string, value interface{}) error {
+	return m.modify(s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		return pathSet(data, path, cloneJSON(value))
+	})
+}
+
+func (m *memoryStore) DeleteStatePath(s *state, op string, path []string) error {
+	return m.modify(s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		return pathDelete(data, path)
+	})
+}
+
+func (m *memoryStore) IncrStatePath(s *state, op string, path []string, by float64, min, max *float64) (float64, error) {
+	var n float64
+	err := m.modify(s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		data, n, err = pathIncr(data, path, by, min, max)
+		return data, err
+	})
+
+	return n, err
+}
+
+func (m *memoryStore) ArrayStatePath(s *state, op string, path []string, a arrayOp) ([]interface{}, error) {
+	a.Value = cloneJSON(a.Value)
+
+	var arr []interface{}
+	err := m.modify(s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		data, arr, err = applyArrayOp(data, path, a)
+		if err == nil {
+			arr = cloneJSON(arr).([]interface{})
+		}
+		return data, err
+	})
+
+	return arr, err
+}
+
+func (m *memoryStore) setKey(s *state, op, key string, value interface{}) error {
+	return m.write(s, op, key, func(cur *state) (*state, error) {
+		if cur != nil {
+			if cur.Data == nil {
+				cur.Data = make(map[string]interface{})
+			}
+			cur.Data[key] = value
+		}
+		return cur, nil
+	})
+}
+
+func (m *memoryStore) DeleteState(s *state) error {
+	return m.write(s, "deleteState", "", func(cur *state) (*state, error) {
+		return nil, nil
+	})
+}
+
+func (m *memoryStore) DeleteStateJSON(s *state, value string) error {
+	return m.write(s, "deleteStateJSON", value, func(cur *state) (*state, error) {
+		if cur != nil {
+			delete(cur.Data, value)
+		}
+		return cur, nil
+	})
+}
+
+func (m *memoryStore) QueryState(s *state, q jsonQuery) ([]interface{}, error) {
+	return nil, errQueryUnsupported
+}
+
+func (m *memoryStore) QueryStates(tag string, q jsonQuery) (map[string][]interface{}, error) {
+	return nil, errQueryUnsupported
+}
+
+func (m *memoryStore) GetHistory(stateID string, after, limit int) ([]revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	history := []revision{}
+	for _, h := range m.history[stateID] {
+		if h.Rev > after {
+			history = append(history, h)
+		}
+	}
+	if limit > 0 && limit < len(history) {
+		history = history[len(history)-limit:]
+	}
+
+	return history, nil
+}
+
+func (m *memoryStore) GetRooms() ([]room, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return aggregateRooms(m.users()), nil
+}
+
+func (m *memoryStore) GetRoom(r *room, id int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	found, ok := findRoom(m.users(), id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*r = found
+
+	return nil
+}
+
+func (m *memoryStore) users() []map[string]interface{} {
+	st, ok := m.states["users"]
+	if !ok {
+		return []map[string]interface{}{}
+	}
+
+	return galaxyUsers(cloneMap(st.Data))
+}
+
+func cloneMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	return cloneJSON(m).(map[string]interface{})
+}
+
+func cloneJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			c[k] = cloneJSON(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, e := range t {
+			c[i] = cloneJSON(e)
+		}
+		return c
+	default:
+		return t
+	}
+}
@@ -0,0 +1,109 @@
+// store_memory_test.go
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestMemoryStore(t *testing.T) *memoryStore {
+	m, err := newMemoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestMemoryStore(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	s := state{StateID: "first", Data: map[string]interface{}{}}
+	if err := m.PostState(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != 1 {
+		t.Errorf("Expected state ID to be '1'. Got '%v'", s.ID)
+	}
+
+	testStore(t, m)
+}
+
+func TestMemoryStoreRooms(t *testing.T) {
+	m := newTestMemoryStore(t)
+
+	users := state{StateID: "users", Tag: "galaxy", Data: map[string]interface{}{
+		"u1": map[string]interface{}{"room": 10.0, "janus": "gxy1", "group": "A", "timestamp": 3.0},
+		"u2": map[string]interface{}{"room": 20.0, "janus": "gxy2", "group": "B", "timestamp": 1.0},
+		"u3": map[string]interface{}{"room": 10.0, "janus": "gxy1", "group": "A", "timestamp": 2.0, "question": true},
+		"u4": map[string]interface{}{"name": "no room"},
+	}}
+	m.PostState(&users)
+
+	rooms, err := m.GetRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rooms) != 2 || rooms[0].Room != 20 || rooms[1].Room != 10 {
+		t.Fatalf("Expected rooms 20 and 10 ordered by timestamp. Got '%v'", rooms)
+	}
+	if rooms[1].NumUsers != 2 || !rooms[1].Questions {
+		t.Errorf("Expected room 10 to have 2 users and a question. Got '%v'", rooms[1])
+	}
+	if rooms[0].Janus != "gxy2" || rooms[0].Group != "B" || rooms[0].Questions {
+		t.Errorf("Expected room 20 on gxy2 without questions. Got '%v'", rooms[0])
+	}
+
+	var r room
+	if err := m.GetRoom(&r, 10); err != nil {
+		t.Fatal(err)
+	}
+	if r.NumUsers != 2 || r.Janus != "gxy1" {
+		t.Errorf("Expected room 10 with 2 users. Got '%v'", r)
+	}
+
+	if err := m.GetRoom(&r, 30); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows. Got '%v'", err)
+	}
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsondb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+	m, err := newMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := state{StateID: "config", Tag: "app", Data: map[string]interface{}{"k": "v"}}
+	m.PostState(&s)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = newMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, _ := m.GetStateByTag("app")
+	if data, ok := states["config"].(map[string]interface{}); !ok || data["k"] != "v" {
+		t.Errorf("Expected the snapshot to be restored. Got '%v'", states)
+	}
+
+	n := state{StateID: "other"}
+	m.PostState(&n)
+	if n.ID != 2 {
+		t.Errorf("Expected IDs to continue after the snapshot. Got '%v'", n.ID)
+	}
+}
@@ -0,0 +1,335 @@
+// store_mssql.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	_ "github.com/denisenkom/go-mssqldb"
+)
+
+const mssqlSchema = `IF OBJECT_ID(N'state', N'U') IS NULL
+CREATE TABLE state
+(
+id BIGINT IDENTITY(1,1) NOT NULL,
+state_id NVARCHAR(450) NOT NULL,
+data NVARCHAR(MAX) NOT NULL,
+tag NVARCHAR(450),
+CONSTRAINT state_pkey PRIMARY KEY (state_id),
+CONSTRAINT state_data_json CHECK (ISJSON(data) = 1)
+);
+IF COL_LENGTH(N'state', N'rev') IS NULL
+ALTER TABLE state ADD rev BIGINT NOT NULL DEFAULT 0;
+IF COL_LENGTH(N'state', N'created_at') IS NULL
+ALTER TABLE state ADD created_at DATETIMEOFFSET NOT NULL DEFAULT SYSDATETIMEOFFSET();
+IF COL_LENGTH(N'state', N'updated_at') IS NULL
+ALTER TABLE state ADD updated_at DATETIMEOFFSET NOT NULL DEFAULT SYSDATETIMEOFFSET();
+IF OBJECT_ID(N'state_history', N'U') IS NULL
+CREATE TABLE state_history
+(
+id BIGINT IDENTITY(1,1) NOT NULL,
+state_id NVARCHAR(450) NOT NULL,
+rev BIGINT NOT NULL,
+op NVARCHAR(64) NOT NULL,
+[key] NVARCHAR(450),
+old_value NVARCHAR(MAX),
+new_value NVARCHAR(MAX),
+client NVARCHAR(450),
+created_at DATETIMEOFFSET NOT NULL DEFAULT SYSDATETIMEOFFSET(),
+CONSTRAINT state_history_pkey PRIMARY KEY (id),
+CONSTRAINT state_history_state_rev UNIQUE (state_id, rev)
+)`
+
+var mssqlHistory = historySQL{
+	// HOLDLOCK keeps the key range locked when the state does not exist yet.
+	lock:    "SELECT 1 FROM state WITH (UPDLOCK, HOLDLOCK) WHERE state_id = @p1",
+	current: "SELECT data, rev FROM state WHERE state_id = @p1",
+	lastRev: "SELECT COALESCE(MAX(rev), 0) FROM state_history WHERE state_id = @p1",
+	insert:  "INSERT INTO state_history(state_id, rev, op, [key], old_value, new_value, client) VALUES(@p1, @p2, @p3, @p4, @p5, @p6, @p7)",
+	touch:   "UPDATE state SET updated_at = SYSDATETIMEOFFSET() WHERE state_id = @p1",
+	update:  "UPDATE state SET data = @p2, rev = @p3 WHERE state_id = @p1",
+}
+
+type mssqlStore struct {
+	db *sql.DB
+}
+
+func newMSSQLStore(db *sql.DB) (*mssqlStore, error) {
+	if _, err := db.Exec(mssqlSchema); err != nil {
+		return nil, err
+	}
+
+	return &mssqlStore{db: db}, nil
+}
+
+func (m *mssqlStore) write(s *state, op, key string, apply func(tx *sql.Tx, rev int) error) error {
+	return writeWithHistory(m.db, mssqlHistory, s, op, key, apply)
+}
+
+func (m *mssqlStore) Close() error {
+	return m.db.Close()
+}
+
+func (m *mssqlStore) scanStates(rows *sql.Rows) ([]state, error) {
+	defer rows.Close()
+
+	states := []state{}
+
+	for rows.Next() {
+		var s state
+		var obj string
+		if err := rows.Scan(&s.ID, &s.StateID, &obj, &s.Tag, &s.Rev, &s.Created, &s.Updated); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(obj), &s.Data)
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+func (m *mssqlStore) GetStates() ([]state, error) {
+	rows, err := m.db.Query(
+		"SELECT id, state_id, data, tag, rev, created_at, updated_at FROM state ORDER BY tag")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.scanStates(rows)
+}
+
+func (m *mssqlStore) GetStateByTag(tag string) (map[string]interface{}, error) {
+	rows, err := m.db.Query(
+		"SELECT state_id, data FROM state WHERE tag = @p1 ORDER BY state_id DESC",
+		tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	states := make(map[string]interface{})
+
+	for rows.Next() {
+		var id, obj string
+		var o map[string]interface{}
+		if err := rows.Scan(&id, &obj); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(obj), &o)
+		states[id] = o
+	}
+
+	return states, rows.Err()
+}
+
+// FindStates filters the states of the tag in Go, SQL Server has no JSON
+// containment operator.
+func (m *mssqlStore) FindStates(q search) ([]state, error) {
+	rows, err := m.db.Query(
+		"SELECT id, state_id, data, tag, rev, created_at, updated_at FROM state WHERE @p1 = '' OR tag = @p1 ORDER BY id",
+		q.Tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := m.scanStates(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterStates(states, q), nil
+}
+
+func (m *mssqlStore) GetState(s *state) error {
+	var obj string
+	err := m.db.QueryRow("SELECT data, rev, created_at, updated_at FROM state WHERE state_id = @p1",
+		s.StateID).Scan(&obj, &s.Rev, &s.Created, &s.Updated)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(obj), &s.Data)
+}
+
+func (m *mssqlStore) PostState(s *state) error {
+	v, _ := json.Marshal(s.Data)
+
+	return m.write(s, "postState", "", func(tx *sql.Tx, rev int) error {
+		return tx.QueryRow(
+			`MERGE state WITH (HOLDLOCK) AS t USING (SELECT @p1 AS state_id) AS src ON t.state_id = src.state_id
+WHEN MATCHED THEN UPDATE SET data = @p2, rev = @p4
+WHEN NOT MATCHED THEN INSERT (state_id, data, tag, rev) VALUES (@p1, @p2, @p3, @p4)
+OUTPUT inserted.id;`,
+			s.StateID, string(v), s.Tag, rev).Scan(&s.ID)
+	})
+}
+
+func (m *mssqlStore) UpdateState(s *state) error {
+	v, _ := json.Marshal(s.Data)
+
+	return m.write(s, "updateState", "", func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = @p2, rev = @p3 WHERE state_id = @p1",
+			s.StateID, string(v), rev)
+		return err
+	})
+}
+
+func (m *mssqlStore) ModifyState(s *state, op string, fn modifier) error {
+	return modifyWithHistory(m.db, mssqlHistory, s, op, "", fn)
+}
+
+func (m *mssqlStore) GetStatePath(s *state, path []string) (interface{}, error) {
+	if err := m.GetState(s); err != nil {
+		return nil, err
+	}
+
+	return pathGet(s.Data, path)
+}
+
+func (m *mssqlStore) PostStatePath(s *state, op string, path []string, value interface{}) error {
+	return modifyWithHistory(m.db, mssqlHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		return pathSet(data, path, value)
+	})
+}
+
+func (m *mssqlStore) DeleteStatePath(s *state, op string, path []string) error {
+	return modifyWithHistory(m.db, mssqlHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		return pathDelete(data, path)
+	})
+}
+
+func (m *mssqlStore) IncrStatePath(s *state, op string, path []string, by float64, min, max *float64) (float64, error) {
+	var n float64
+	err := modifyWithHistory(m.db, mssqlHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		data, n, err = pathIncr(data, path, by, min, max)
+		return data, err
+	})
+
+	return n, err
+}
+
+func (m *mssqlStore) ArrayStatePath(s *state, op string, path []string, a arrayOp) ([]interface{}, error) {
+	var arr []interface{}
+	err := modifyWithHistory(m.db, mssqlHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		data, arr, err = applyArrayOp(data, path, a)
+		return data, err
+	})
+
+	return arr, err
+}
+
+// setKey updates the data with the given expression, which may refer to the
+// key path as @p2 and to the value argument as @p3.
+func (m *mssqlStore) setKey(s *state, op, key string, expr string, value interface{}) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+
+	return m.write(s, op, key, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = "+expr+", rev = @p4 WHERE state_id = @p1",
+			s.StateID, path, value, rev)
+		return err
+	})
+}
+
+func (m *mssqlStore) PostStateValue(s *state, value interface{}, key string) error {
+	if value == nil {
+		// NULL removes the key in lax mode, so the key is created first and
+		// set to null in strict mode.
+		return m.setKey(s, "postStateValue", key, "JSON_MODIFY(JSON_MODIFY(data, @p2, 0), 'strict ' + @p2, NULL)", nil)
+	}
+
+	return m.setKey(s, "postStateValue", key, "JSON_MODIFY(data, @p2, @p3)", value)
+}
+
+func (m *mssqlStore) PostStateJSON(s *state, value interface{}, key string) error {
+	v, _ := json.Marshal(value)
+
+	return m.setKey(s, "postStateJSON", key, "JSON_MODIFY(data, @p2, JSON_QUERY(@p3))", string(v))
+}
+
+func (m *mssqlStore) DeleteState(s *state) error {
+	return m.write(s, "deleteState", "", func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("DELETE FROM state WHERE state_id = @p1", s.StateID)
+		return err
+	})
+}
+
+func (m *mssqlStore) DeleteStateJSON(s *state, value string) error {
+	path, err := keyPath(value)
+	if err != nil {
+		return err
+	}
+
+	// In lax mode JSON_MODIFY removes the key when the new value is NULL.
+	return m.write(s, "deleteStateJSON", value, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = JSON_MODIFY(data, @p2, NULL), rev = @p3 WHERE state_id = @p1",
+			s.StateID, path, rev)
+		return err
+	})
+}
+
+func (m *mssqlStore) QueryState(s *state, q jsonQuery) ([]interface{}, error) {
+	return nil, errQueryUnsupported
+}
+
+func (m *mssqlStore) QueryStates(tag string, q jsonQuery) (map[string][]interface{}, error) {
+	return nil, errQueryUnsupported
+}
+
+func (m *mssqlStore) GetHistory(stateID string, after, limit int) ([]revision, error) {
+	rows, err := m.db.Query(
+		"SELECT * FROM (SELECT TOP (CASE WHEN @p3 > 0 THEN @p3 ELSE 2147483647 END) rev, op, COALESCE([key], '') AS [key], old_value, new_value, COALESCE(client, '') AS client, created_at FROM state_history WHERE state_id = @p1 AND rev > @p2 ORDER BY rev DESC) h ORDER BY rev",
+		stateID, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanHistory(stateID, rows)
+}
+
+func (m *mssqlStore) users() ([]map[string]interface{}, error) {
+	s := state{StateID: "users"}
+	err := m.GetState(&s)
+	if err == sql.ErrNoRows {
+		return []map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return galaxyUsers(s.Data), nil
+}
+
+func (m *mssqlStore) GetRooms() ([]room, error) {
+	users, err := m.users()
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregateRooms(users), nil
+}
+
+func (m *mssqlStore) GetRoom(r *room, id int) error {
+	users, err := m.users()
+	if err != nil {
+		return err
+	}
+
+	found, ok := findRoom(users, id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*r = found
+
+	return nil
+}
@@ -0,0 +1,556 @@
+// store_postgres.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+type postgresStore struct {
+	db      *sql.DB
+	history historySQL
+}
+
+const postgresSchema = `ALTER TABLE state ADD COLUMN IF NOT EXISTS rev BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE state ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE state ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+CREATE TABLE IF NOT EXISTS state_history
+(
+id BIGSERIAL,
+state_id TEXT NOT NULL,
+rev BIGINT NOT NULL,
+op TEXT NOT NULL,
+key TEXT,
+old_value jsonb,
+new_value jsonb,
+client TEXT,
+created_at timestamptz NOT NULL DEFAULT now(),
+CONSTRAINT state_history_pkey PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS state_history_state_rev ON state_history (state_id, rev);`
+
+// newPostgresStore makes a store whose writes also NOTIFY their change when
+// notify is set, see pgNotifier.
+func newPostgresStore(db *sql.DB, notify bool) (*postgresStore, error) {
+	if _, err := db.Exec(postgresSchema); err != nil {
+		return nil, err
+	}
+
+	p := &postgresStore{db: db, history: postgresHistory}
+	if notify {
+		p.history = postgresNotifyHistory
+	}
+
+	return p, nil
+}
+
+func (p *postgresStore) Close() error {
+	return p.db.Close()
+}
+
+func roomVars(id int) string {
+	v, _ := json.Marshal(map[string]int{"room": id})
+
+	return string(v)
+}
+
+// roomsQuery groups the users selected by the jsonb path $1, with the
+// variables $2, by room in one scan of the users state. The first user by
+// timestamp describes the room, users keep their order in the document.
+const roomsQuery = `SELECT (first -> 'janus')::text, room, (first -> 'group')::text, users, questions FROM (
+SELECT (u -> 'room')::text::bigint AS room,
+(array_agg(u ORDER BY (u -> 'timestamp')::text::bigint, n))[1] AS first,
+min((u -> 'timestamp')::text::bigint) AS stamp,
+jsonb_agg(u ORDER BY n) AS users,
+COALESCE(bool_or(u -> 'question' = 'true'), false) AS questions
+FROM state, jsonb_path_query(data, $1::jsonpath, $2::jsonb) WITH ORDINALITY AS e(u, n)
+WHERE state_id = 'users' AND (u -> 'room') IS NOT NULL
+GROUP BY 1) r
+ORDER BY stamp, room`
+
+func (p *postgresStore) GetRooms() ([]room, error) {
+	rows, err := p.db.Query(roomsQuery, "$.*", "{}")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	rooms := []room{}
+
+	for rows.Next() {
+		var r room
+		var users []interface{}
+		var obj []byte
+		var grp []byte
+		var gxy []byte
+		if err := rows.Scan(&gxy, &r.Room, &grp, &obj, &r.Questions); err != nil {
+			return nil, err
+		}
+
+		json.Unmarshal(obj, &users)
+		json.Unmarshal(gxy, &r.Janus)
+		json.Unmarshal(grp, &r.Group)
+		r.Users = users
+		r.NumUsers = len(users)
+		rooms = append(rooms, r)
+	}
+
+	return rooms, rows.Err()
+}
+
+// GetRoom runs the rooms query on the users of the room only. A room without
+// users has no group, Scan reports sql.ErrNoRows.
+func (p *postgresStore) GetRoom(r *room, id int) error {
+	var users []interface{}
+	var obj []byte
+	var grp []byte
+	var gxy []byte
+
+	err := p.db.QueryRow(roomsQuery, "$.* ? (@.room == $room)", roomVars(id)).Scan(&gxy, &r.Room, &grp, &obj, &r.Questions)
+	if err != nil {
+		return err
+	}
+
+	json.Unmarshal(obj, &users)
+	json.Unmarshal(gxy, &r.Janus)
+	json.Unmarshal(grp, &r.Group)
+	r.Users = users
+	r.NumUsers = len(users)
+
+	return nil
+}
+
+func (p *postgresStore) FindStates(q search) ([]state, error) {
+	contains := make([]string, len(q.Contains))
+	for i, c := range q.Contains {
+		b, _ := json.Marshal(c)
+		contains[i] = string(b)
+	}
+
+	rows, err := p.db.Query(
+		"SELECT id, state_id, data, COALESCE(tag, ''), rev, created_at, updated_at FROM state WHERE ($1 = '' OR tag = $1) AND data @> ALL($2::jsonb[]) ORDER BY id",
+		q.Tag, pq.Array(contains))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	states := []state{}
+
+	for rows.Next() {
+		var s state
+		var obj []byte
+		if err := rows.Scan(&s.ID, &s.StateID, &obj, &s.Tag, &s.Rev, &s.Created, &s.Updated); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(obj, &s.Data)
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+func (p *postgresStore) GetStates() ([]state, error) {
+	rows, err := p.db.Query(
+		"SELECT id, state_id, data, tag, rev, created_at, updated_at FROM state ORDER BY tag")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	states := []state{}
+
+	for rows.Next() {
+		var s state
+		var obj []byte
+		if err := rows.Scan(&s.ID, &s.StateID, &obj, &s.Tag, &s.Rev, &s.Created, &s.Updated); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(obj, &s.Data)
+		states = append(states, s)
+	}
+
+	return states, nil
+}
+
+func (p *postgresStore) GetStateByTag(tag string) (map[string]interface{}, error) {
+	rows, err := p.db.Query(
+		"SELECT id, state_id, data FROM state WHERE tag = $1 ORDER BY state_id DESC",
+		tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	states := make(map[string]interface{})
+
+	for rows.Next() {
+		var s state
+		var o map[string]interface{}
+		var obj []byte
+		if err := rows.Scan(&s.ID, &s.StateID, &obj); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(obj, &o)
+		states[s.StateID] = o
+	}
+
+	return states, nil
+}
+
+func (p *postgresStore) GetState(s *state) error {
+	var obj []byte
+	err := p.db.QueryRow("SELECT data, rev, created_at, updated_at FROM state WHERE state_id = $1",
+		s.StateID).Scan(&obj, &s.Rev, &s.Created, &s.Updated)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(obj, &s.Data)
+
+	return err
+}
+
+var postgresHistory = historySQL{
+	lock:    "SELECT pg_advisory_xact_lock(hashtext($1))",
+	current: "SELECT data, rev FROM state WHERE state_id = $1",
+	value:   "SELECT data #> ARRAY(SELECT jsonb_array_elements_text($2::jsonb)), rev FROM state WHERE state_id = $1",
+	lastRev: "SELECT COALESCE(MAX(rev), 0) FROM state_history WHERE state_id = $1",
+	insert:  "INSERT INTO state_history(state_id, rev, op, key, old_value, new_value, client) VALUES($1, $2, $3, $4, $5, $6, $7)",
+	touch:   "UPDATE state SET updated_at = now() WHERE state_id = $1",
+	update:  "UPDATE state SET data=$2, rev=$3 WHERE state_id=$1",
+}
+
+// postgresNotifyHistory also sends the change of a write with NOTIFY inside
+// its transaction, so that it is delivered on commit and in commit order.
+var postgresNotifyHistory = func() historySQL {
+	h := postgresHistory
+	h.tag = "SELECT tag FROM state WHERE state_id = $1"
+	h.notify = "SELECT pg_notify('" + pgChannel + "', $1)"
+	return h
+}()
+
+// postgresUsers keep the galaxy users in state_user. Writers of different
+// users only share the short update of the header revision.
+var postgresUsers = usersSQL{
+	schema: `CREATE TABLE IF NOT EXISTS state_user
+(
+user_id TEXT NOT NULL,
+data jsonb NOT NULL,
+CONSTRAINT state_user_pkey PRIMARY KEY (user_id)
+);
+CREATE INDEX IF NOT EXISTS state_user_room ON state_user ((data -> 'room'));`,
+	exists:     "SELECT to_regclass('state_user') IS NOT NULL",
+	lockWrite:  "LOCK TABLE state_user IN ROW EXCLUSIVE MODE",
+	lockAll:    "LOCK TABLE state_user IN SHARE ROW EXCLUSIVE MODE",
+	lockUser:   "SELECT pg_advisory_xact_lock(hashtext('state_user/' || $1))",
+	lockHeader: "SELECT 1 FROM state WHERE state_id = $1 FOR UPDATE",
+	header:     "SELECT id, COALESCE(tag, ''), rev, created_at, updated_at FROM state WHERE state_id = $1",
+	create:     "INSERT INTO state(state_id, data, tag, rev) SELECT $1, '{}', $2, COALESCE(MAX(rev), 0) FROM state_history WHERE state_id = $1 ON CONFLICT (state_id) DO NOTHING",
+	bump:       "UPDATE state SET rev = rev + 1, updated_at = now() WHERE state_id = $1 RETURNING rev",
+	drop:       "DELETE FROM state WHERE state_id = $1",
+	all:        "SELECT user_id, data FROM state_user",
+	user:       "SELECT data FROM state_user WHERE user_id = $1",
+	room:       "SELECT user_id, data FROM state_user WHERE data -> 'room' = $1::jsonb",
+	put:        "INSERT INTO state_user(user_id, data) VALUES($1, $2) ON CONFLICT (user_id) DO UPDATE SET data = $2",
+	remove:     "DELETE FROM state_user WHERE user_id = $1",
+	clear:      "DELETE FROM state_user",
+	query:      "SELECT jsonb_path_query_array(COALESCE(jsonb_object_agg(user_id, data), '{}'), $1::jsonpath, $2::jsonb) FROM state_user",
+	history:    postgresHistory,
+}
+
+func (p *postgresStore) write(s *state, op, key string, apply func(tx *sql.Tx, rev int) error) error {
+	return writeWithHistory(p.db, p.history, s, op, key, apply)
+}
+
+func (p *postgresStore) PostState(s *state) error {
+	v, _ := json.Marshal(s.Data)
+
+	return p.write(s, "postState", "", func(tx *sql.Tx, rev int) error {
+		return tx.QueryRow(
+			"INSERT INTO state(state_id, data, tag, rev) VALUES($1, $2, $3, $4) ON CONFLICT (state_id) DO UPDATE SET data = $2, rev = $4 WHERE state.state_id = $1 RETURNING id",
+			s.StateID, v, s.Tag, rev).Scan(&s.ID)
+	})
+}
+
+func (p *postgresStore) UpdateState(s *state) error {
+	v, _ := json.Marshal(s.Data)
+
+	return p.write(s, "updateState", "", func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data=$2, rev=$3 WHERE state_id=$1",
+			s.StateID, v, rev)
+		return err
+	})
+}
+
+func (p *postgresStore) PostStateValue(s *state, value interface{}, key string) error {
+	v, _ := json.Marshal(value)
+
+	return p.write(s, "postStateValue", key, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = data || jsonb_build_object($3::text, $2::jsonb), rev = $4 WHERE state_id=$1",
+			s.StateID, string(v), key, rev)
+		return err
+	})
+}
+
+func (p *postgresStore) PostStateJSON(s *state, value interface{}, key string) error {
+	v, _ := json.Marshal(value)
+
+	return p.write(s, "postStateJSON", key, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = data || json_build_object($3::text, $2::jsonb)::jsonb, rev = $4 WHERE state_id=$1",
+			s.StateID, v, key, rev)
+		return err
+	})
+}
+
+func (p *postgresStore) ModifyState(s *state, op string, fn modifier) error {
+	return modifyWithHistory(p.db, p.history, s, op, "", fn)
+}
+
+func (p *postgresStore) GetStatePath(s *state, path []string) (interface{}, error) {
+	var obj []byte
+	err := p.db.QueryRow("SELECT data #> $2, rev FROM state WHERE state_id = $1",
+		s.StateID, pq.Array(path)).Scan(&obj, &s.Rev)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, errPathNotFound
+	}
+
+	var v interface{}
+	err = json.Unmarshal(obj, &v)
+
+	return v, err
+}
+
+// pathWrite runs a path update that only applies when the parent of path is
+// an object or an array.
+func (p *postgresStore) pathWrite(s *state, op string, path []string, query string, args ...interface{}) error {
+	return p.write(s, op, pathKey(path), func(tx *sql.Tx, rev int) error {
+		args := append([]interface{}{s.StateID, pq.Array(path), pq.Array(path[:len(path)-1]), rev}, args...)
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errPathNotFound
+		}
+		return nil
+	})
+}
+
+// resolvePath reads the data of a state inside a write and resolves path in
+// it, see resolvePath.
+func (p *postgresStore) resolvePath(tx *sql.Tx, id string, path []string) ([]string, error) {
+	var obj []byte
+	if err := tx.QueryRow("SELECT data FROM state WHERE state_id = $1", id).Scan(&obj); err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(obj, &data); err != nil {
+		return nil, err
+	}
+
+	return resolvePath(data, path)
+}
+
+// IncrStatePath does the arithmetic in the UPDATE itself. GREATEST and LEAST
+// ignore a NULL min or max.
+func (p *postgresStore) IncrStatePath(s *state, op string, path []string, by float64, min, max *float64) (float64, error) {
+	var n float64
+	err := p.write(s, op, pathKey(path), func(tx *sql.Tx, rev int) error {
+		path, err := p.resolvePath(tx, s.StateID, path)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(
+			`UPDATE state SET data = jsonb_set(data, $2, to_jsonb(LEAST(GREATEST(COALESCE((data #>> $2)::numeric, 0) + $5, $6), $7)), true), rev = $4
+WHERE state_id = $1 AND jsonb_typeof(data #> $3) IN ('object', 'array') AND COALESCE(jsonb_typeof(data #> $2), 'number') = 'number'
+RETURNING (data #>> $2)::float8`,
+			s.StateID, pq.Array(path), pq.Array(path[:len(path)-1]), rev, by, min, max).Scan(&n)
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		var parent, target sql.NullString
+		err = tx.QueryRow("SELECT jsonb_typeof(data #> $3), jsonb_typeof(data #> $2) FROM state WHERE state_id = $1",
+			s.StateID, pq.Array(path), pq.Array(path[:len(path)-1])).Scan(&parent, &target)
+		if err == nil && (parent.String == "object" || parent.String == "array") {
+			return errNotNumber
+		}
+		if err == nil || err == sql.ErrNoRows {
+			return errPathNotFound
+		}
+		return err
+	})
+
+	return n, err
+}
+
+// postgresArrayOps are the new array of each arrayOp, $5 is the value or the
+// index.
+var postgresArrayOps = map[string]string{
+	"append":      "COALESCE(data #> $2, '[]') || jsonb_build_array($5::jsonb)",
+	"prepend":     "jsonb_build_array($5::jsonb) || COALESCE(data #> $2, '[]')",
+	"add":         "CASE WHEN EXISTS (SELECT 1 FROM jsonb_array_elements(COALESCE(data #> $2, '[]')) e WHERE e = $5::jsonb) THEN data #> $2 ELSE COALESCE(data #> $2, '[]') || jsonb_build_array($5::jsonb) END",
+	"removeIndex": "(data #> $2) - $5::int",
+	"removeValue": "COALESCE((SELECT jsonb_agg(e ORDER BY i) FROM jsonb_array_elements(data #> $2) WITH ORDINALITY t(e, i) WHERE e <> $5::jsonb), '[]')",
+	"removeMatch": "COALESCE((SELECT jsonb_agg(e ORDER BY i) FROM jsonb_array_elements(data #> $2) WITH ORDINALITY t(e, i) WHERE NOT e @> $5::jsonb), '[]')",
+}
+
+func (p *postgresStore) ArrayStatePath(s *state, op string, path []string, a arrayOp) ([]interface{}, error) {
+	// Removes need an existing array, removeIndex an existing element.
+	cond := "COALESCE(jsonb_typeof(data #> $2), 'array') = 'array'"
+	var arg interface{}
+	switch a.Op {
+	case "removeIndex":
+		cond = "jsonb_typeof(data #> $2) = 'array' AND jsonb_array_length(data #> $2) > $5::int"
+		arg = a.Index
+	case "removeValue", "removeMatch":
+		cond = "jsonb_typeof(data #> $2) = 'array'"
+		fallthrough
+	default:
+		v, _ := json.Marshal(a.Value)
+		arg = string(v)
+	}
+
+	var arr []interface{}
+	err := p.write(s, op, pathKey(path), func(tx *sql.Tx, rev int) error {
+		path, err := p.resolvePath(tx, s.StateID, path)
+		if err != nil {
+			return err
+		}
+
+		var obj []byte
+		err = tx.QueryRow(
+			"UPDATE state SET data = jsonb_set(data, $2, "+postgresArrayOps[a.Op]+", true), rev = $4 WHERE state_id = $1 AND jsonb_typeof(data #> $3) IN ('object', 'array') AND "+cond+" RETURNING data #> $2",
+			s.StateID, pq.Array(path), pq.Array(path[:len(path)-1]), rev, arg).Scan(&obj)
+		if err == sql.ErrNoRows {
+			var target sql.NullString
+			err = tx.QueryRow("SELECT jsonb_typeof(data #> $2) FROM state WHERE state_id = $1",
+				s.StateID, pq.Array(path)).Scan(&target)
+			if err == nil && target.Valid && target.String != "array" {
+				return errNotArray
+			}
+			if err == nil || err == sql.ErrNoRows {
+				return errPathNotFound
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(obj, &arr)
+	})
+
+	return arr, err
+}
+
+func (p *postgresStore) PostStatePath(s *state, op string, path []string, value interface{}) error {
+	v, _ := json.Marshal(value)
+
+	return p.pathWrite(s, op, path,
+		"UPDATE state SET data = jsonb_set(data, $2, $5::jsonb, true), rev = $4 WHERE state_id = $1 AND jsonb_typeof(data #> $3) IN ('object', 'array')",
+		string(v))
+}
+
+func (p *postgresStore) DeleteStatePath(s *state, op string, path []string) error {
+	return p.pathWrite(s, op, path,
+		"UPDATE state SET data = data #- $2, rev = $4 WHERE state_id = $1 AND jsonb_typeof(data #> $3) IN ('object', 'array')")
+}
+
+func (p *postgresStore) DeleteState(s *state) error {
+	return p.write(s, "deleteState", "", func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("DELETE FROM state WHERE state_id=$1", s.StateID)
+		return err
+	})
+}
+
+func (p *postgresStore) DeleteStateJSON(s *state, value string) error {
+	return p.write(s, "deleteStateJSON", value, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = data - $2, rev = $3 WHERE state_id=$1",
+			s.StateID, value, rev)
+		return err
+	})
+}
+
+func (p *postgresStore) QueryState(s *state, q jsonQuery) ([]interface{}, error) {
+	vars, _ := json.Marshal(q.Vars)
+
+	var obj []byte
+	err := p.db.QueryRow("SELECT jsonb_path_query_array(data, $2::jsonpath, $3::jsonb), rev FROM state WHERE state_id = $1",
+		s.StateID, q.Path, string(vars)).Scan(&obj, &s.Rev)
+	if err != nil {
+		return nil, jsonPathError(err)
+	}
+
+	items := []interface{}{}
+	err = json.Unmarshal(obj, &items)
+
+	return items, err
+}
+
+func (p *postgresStore) QueryStates(tag string, q jsonQuery) (map[string][]interface{}, error) {
+	vars, _ := json.Marshal(q.Vars)
+
+	rows, err := p.db.Query(
+		"SELECT state_id, jsonb_path_query_array(data, $2::jsonpath, $3::jsonb) FROM state WHERE tag = $1 AND jsonb_path_exists(data, $2::jsonpath, $3::jsonb)",
+		tag, q.Path, string(vars))
+
+	if err != nil {
+		return nil, jsonPathError(err)
+	}
+
+	defer rows.Close()
+
+	found := make(map[string][]interface{})
+
+	for rows.Next() {
+		var id string
+		var obj []byte
+		var items []interface{}
+		if err := rows.Scan(&id, &obj); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(obj, &items)
+		found[id] = items
+	}
+
+	return found, jsonPathError(rows.Err())
+}
+
+// jsonPathError reports syntax errors, missing variables and the errors of
+// strict mode as invalid queries.
+func jsonPathError(err error) error {
+	if e, ok := err.(*pq.Error); ok && (e.Code.Class() == "22" || e.Code == "42601" || e.Code == "42704") {
+		return fmt.Errorf("%w: %s", errInvalidJSONPath, e.Message)
+	}
+
+	return err
+}
+
+func (p *postgresStore) GetHistory(stateID string, after, limit int) ([]revision, error) {
+	rows, err := p.db.Query(
+		"SELECT * FROM (SELECT rev, op, COALESCE(key, ''), old_value, new_value, COALESCE(client, ''), created_at FROM state_history WHERE state_id = $1 AND rev > $2 ORDER BY rev DESC LIMIT NULLIF($3, 0)) h ORDER BY rev",
+		stateID, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanHistory(stateID, rows)
+}
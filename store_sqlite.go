@@ -0,0 +1,384 @@
+// store_sqlite.go
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS state
+(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+state_id TEXT NOT NULL UNIQUE,
+data TEXT NOT NULL,
+tag TEXT
+);
+CREATE TABLE IF NOT EXISTS state_history
+(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+state_id TEXT NOT NULL,
+rev INTEGER NOT NULL,
+op TEXT NOT NULL,
+key TEXT,
+old_value TEXT,
+new_value TEXT,
+client TEXT,
+created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE (state_id, rev)
+)`
+
+// sqliteNow is the current time with milliseconds, CURRENT_TIMESTAMP only
+// has seconds.
+const sqliteNow = "strftime('%Y-%m-%d %H:%M:%f', 'now')"
+
+var sqliteHistory = historySQL{
+	current: "SELECT data, rev FROM state WHERE state_id = ?1",
+	lastRev: "SELECT COALESCE(MAX(rev), 0) FROM state_history WHERE state_id = ?1",
+	insert:  "INSERT INTO state_history(state_id, rev, op, key, old_value, new_value, client) VALUES(?1, ?2, ?3, ?4, ?5, ?6, ?7)",
+	touch:   "UPDATE state SET updated_at = " + sqliteNow + ", created_at = COALESCE(created_at, " + sqliteNow + ") WHERE state_id = ?1",
+	update:  "UPDATE state SET data = json(?2), rev = ?3 WHERE state_id = ?1",
+}
+
+// sqliteUsers keep the galaxy users in state_user. SQLite serializes the
+// writers, no locks are needed.
+var sqliteUsers = usersSQL{
+	schema: `CREATE TABLE IF NOT EXISTS state_user
+(
+user_id TEXT NOT NULL PRIMARY KEY,
+data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS state_user_room ON state_user (json_extract(data, '$.room'))`,
+	exists:  "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'state_user'",
+	header:  "SELECT id, COALESCE(tag, ''), rev, created_at, updated_at FROM state WHERE state_id = ?1",
+	create:  "INSERT OR IGNORE INTO state(state_id, data, tag, rev, created_at, updated_at) SELECT ?1, '{}', ?2, COALESCE(MAX(rev), 0), " + sqliteNow + ", " + sqliteNow + " FROM state_history WHERE state_id = ?1",
+	bump:    "UPDATE state SET rev = rev + 1, updated_at = " + sqliteNow + " WHERE state_id = ?1 RETURNING rev",
+	drop:    "DELETE FROM state WHERE state_id = ?1",
+	all:     "SELECT user_id, data FROM state_user",
+	user:    "SELECT data FROM state_user WHERE user_id = ?1",
+	room:    "SELECT user_id, data FROM state_user WHERE json_extract(data, '$.room') = CAST(?1 AS INTEGER)",
+	put:     "INSERT INTO state_user(user_id, data) VALUES(?1, json(?2)) ON CONFLICT (user_id) DO UPDATE SET data = excluded.data",
+	remove:  "DELETE FROM state_user WHERE user_id = ?1",
+	clear:   "DELETE FROM state_user",
+	history: sqliteHistory,
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteDSN adds the busy timeout and WAL mode to the options of path. The
+// driver reads the first value of an option, those already in path win.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+
+	return path + sep + "_busy_timeout=5000&_journal_mode=WAL"
+}
+
+func newSQLiteStore(db *sql.DB) (*sqliteStore, error) {
+	// A single connection serializes writers, which SQLite requires anyway.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, err
+	}
+
+	// SQLite cannot add columns with a CURRENT_TIMESTAMP default, the times
+	// are set by the writes and backfilled here.
+	for _, c := range []struct{ name, def string }{
+		{"rev", "INTEGER NOT NULL DEFAULT 0"},
+		{"created_at", "TIMESTAMP"},
+		{"updated_at", "TIMESTAMP"},
+	} {
+		if err := sqliteAddColumn(db, "state", c.name, c.def); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := db.Exec("UPDATE state SET created_at = " + sqliteNow + ", updated_at = " + sqliteNow + " WHERE created_at IS NULL"); err != nil {
+		return nil, err
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func sqliteAddColumn(db *sql.DB, table, name, def string) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?1) WHERE name = ?2", table, name).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + def)
+
+	return err
+}
+
+func (q *sqliteStore) write(s *state, op, key string, apply func(tx *sql.Tx, rev int) error) error {
+	return writeWithHistory(q.db, sqliteHistory, s, op, key, apply)
+}
+
+func (q *sqliteStore) Close() error {
+	return q.db.Close()
+}
+
+func (q *sqliteStore) scanStates(rows *sql.Rows) ([]state, error) {
+	defer rows.Close()
+
+	states := []state{}
+
+	for rows.Next() {
+		var s state
+		var obj string
+		if err := rows.Scan(&s.ID, &s.StateID, &obj, &s.Tag, &s.Rev, &s.Created, &s.Updated); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(obj), &s.Data)
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+func (q *sqliteStore) GetStates() ([]state, error) {
+	rows, err := q.db.Query(
+		"SELECT id, state_id, data, tag, rev, created_at, updated_at FROM state ORDER BY tag")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return q.scanStates(rows)
+}
+
+func (q *sqliteStore) GetStateByTag(tag string) (map[string]interface{}, error) {
+	rows, err := q.db.Query(
+		"SELECT state_id, data FROM state WHERE tag = ?1 ORDER BY state_id DESC",
+		tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	states := make(map[string]interface{})
+
+	for rows.Next() {
+		var id, obj string
+		var o map[string]interface{}
+		if err := rows.Scan(&id, &obj); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(obj), &o)
+		states[id] = o
+	}
+
+	return states, rows.Err()
+}
+
+// FindStates filters the states of the tag in Go, SQLite has no JSON
+// containment operator.
+func (q *sqliteStore) FindStates(s search) ([]state, error) {
+	rows, err := q.db.Query(
+		"SELECT id, state_id, data, tag, rev, created_at, updated_at FROM state WHERE ?1 = '' OR tag = ?1 ORDER BY id",
+		s.Tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := q.scanStates(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterStates(states, s), nil
+}
+
+func (q *sqliteStore) GetState(s *state) error {
+	var obj string
+	err := q.db.QueryRow("SELECT data, rev, created_at, updated_at FROM state WHERE state_id = ?1",
+		s.StateID).Scan(&obj, &s.Rev, &s.Created, &s.Updated)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(obj), &s.Data)
+}
+
+func (q *sqliteStore) PostState(s *state) error {
+	v, _ := json.Marshal(s.Data)
+
+	return q.write(s, "postState", "", func(tx *sql.Tx, rev int) error {
+		return tx.QueryRow(
+			"INSERT INTO state(state_id, data, tag, rev) VALUES(?1, json(?2), ?3, ?4) ON CONFLICT (state_id) DO UPDATE SET data = excluded.data, rev = excluded.rev RETURNING id",
+			s.StateID, string(v), s.Tag, rev).Scan(&s.ID)
+	})
+}
+
+func (q *sqliteStore) UpdateState(s *state) error {
+	v, _ := json.Marshal(s.Data)
+
+	return q.write(s, "updateState", "", func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = json(?2), rev = ?3 WHERE state_id = ?1",
+			s.StateID, string(v), rev)
+		return err
+	})
+}
+
+func (q *sqliteStore) ModifyState(s *state, op string, fn modifier) error {
+	return modifyWithHistory(q.db, sqliteHistory, s, op, "", fn)
+}
+
+func (q *sqliteStore) GetStatePath(s *state, path []string) (interface{}, error) {
+	if err := q.GetState(s); err != nil {
+		return nil, err
+	}
+
+	return pathGet(s.Data, path)
+}
+
+func (q *sqliteStore) PostStatePath(s *state, op string, path []string, value interface{}) error {
+	return modifyWithHistory(q.db, sqliteHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		return pathSet(data, path, value)
+	})
+}
+
+func (q *sqliteStore) DeleteStatePath(s *state, op string, path []string) error {
+	return modifyWithHistory(q.db, sqliteHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		return pathDelete(data, path)
+	})
+}
+
+func (q *sqliteStore) IncrStatePath(s *state, op string, path []string, by float64, min, max *float64) (float64, error) {
+	var n float64
+	err := modifyWithHistory(q.db, sqliteHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		data, n, err = pathIncr(data, path, by, min, max)
+		return data, err
+	})
+
+	return n, err
+}
+
+func (q *sqliteStore) ArrayStatePath(s *state, op string, path []string, a arrayOp) ([]interface{}, error) {
+	var arr []interface{}
+	err := modifyWithHistory(q.db, sqliteHistory, s, op, pathKey(path), func(data map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		data, arr, err = applyArrayOp(data, path, a)
+		return data, err
+	})
+
+	return arr, err
+}
+
+func (q *sqliteStore) setKey(s *state, op, key string, value string) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+
+	return q.write(s, op, key, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = json_set(data, ?2, json(?3)), rev = ?4 WHERE state_id = ?1",
+			s.StateID, path, value, rev)
+		return err
+	})
+}
+
+func (q *sqliteStore) PostStateValue(s *state, value interface{}, key string) error {
+	v, _ := json.Marshal(value)
+
+	return q.setKey(s, "postStateValue", key, string(v))
+}
+
+func (q *sqliteStore) PostStateJSON(s *state, value interface{}, key string) error {
+	v, _ := json.Marshal(value)
+
+	return q.setKey(s, "postStateJSON", key, string(v))
+}
+
+func (q *sqliteStore) DeleteState(s *state) error {
+	return q.write(s, "deleteState", "", func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("DELETE FROM state WHERE state_id = ?1", s.StateID)
+		return err
+	})
+}
+
+func (q *sqliteStore) DeleteStateJSON(s *state, value string) error {
+	path, err := keyPath(value)
+	if err != nil {
+		return err
+	}
+
+	return q.write(s, "deleteStateJSON", value, func(tx *sql.Tx, rev int) error {
+		_, err := tx.Exec("UPDATE state SET data = json_remove(data, ?2), rev = ?3 WHERE state_id = ?1",
+			s.StateID, path, rev)
+		return err
+	})
+}
+
+func (q *sqliteStore) QueryState(s *state, jq jsonQuery) ([]interface{}, error) {
+	return nil, errQueryUnsupported
+}
+
+func (q *sqliteStore) QueryStates(tag string, jq jsonQuery) (map[string][]interface{}, error) {
+	return nil, errQueryUnsupported
+}
+
+func (q *sqliteStore) GetHistory(stateID string, after, limit int) ([]revision, error) {
+	rows, err := q.db.Query(
+		"SELECT * FROM (SELECT rev, op, COALESCE(key, ''), old_value, new_value, COALESCE(client, ''), created_at FROM state_history WHERE state_id = ?1 AND rev > ?2 ORDER BY rev DESC LIMIT CASE WHEN ?3 > 0 THEN ?3 ELSE -1 END) ORDER BY rev",
+		stateID, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanHistory(stateID, rows)
+}
+
+func (q *sqliteStore) users() ([]map[string]interface{}, error) {
+	s := state{StateID: "users"}
+	err := q.GetState(&s)
+	if err == sql.ErrNoRows {
+		return []map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return galaxyUsers(s.Data), nil
+}
+
+func (q *sqliteStore) GetRooms() ([]room, error) {
+	users, err := q.users()
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregateRooms(users), nil
+}
+
+func (q *sqliteStore) GetRoom(r *room, id int) error {
+	users, err := q.users()
+	if err != nil {
+		return err
+	}
+
+	found, ok := findRoom(users, id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*r = found
+
+	return nil
+}
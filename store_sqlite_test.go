@@ -0,0 +1,73 @@
+// store_sqlite_test.go
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLiteStore(t *testing.T) *sqliteStore {
+	dir, err := ioutil.TempDir("", "jsondb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := sql.Open("sqlite3", sqliteDSN(filepath.Join(dir, "state.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := newSQLiteStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	return q
+}
+
+func TestSQLiteStore(t *testing.T) {
+	q := newTestSQLiteStore(t)
+	testStore(t, q)
+
+	s := state{StateID: "room", Data: map[string]interface{}{}}
+	q.PostState(&s)
+	if err := q.DeleteStateJSON(&s, `bad"key`); err != errInvalidKey {
+		t.Errorf("Expected errInvalidKey. Got '%v'", err)
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsondb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := sqliteDSN("file:" + filepath.Join(dir, "state.db") + "?_busy_timeout=100")
+	if want := "file:" + filepath.Join(dir, "state.db") + "?_busy_timeout=100&_busy_timeout=5000&_journal_mode=WAL"; dsn != want {
+		t.Errorf("Expected '%v'. Got '%v'", want, dsn)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var timeout int
+	var mode string
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != 100 || mode != "wal" {
+		t.Errorf("Expected the busy timeout of the DSN and WAL mode. Got %d %s", timeout, mode)
+	}
+}
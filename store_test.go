@@ -0,0 +1,100 @@
+// store_test.go
+
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+// testStore runs the operations every Store has to implement alike against
+// an empty store.
+func testStore(t *testing.T, store Store) {
+	s := state{StateID: "room", Tag: "galaxy", Data: map[string]interface{}{"a": "1", "name": "main"}}
+	if err := store.PostState(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	store.PostStateJSON(&s, map[string]interface{}{"x": 1.0}, "obj")
+	store.PostStateValue(&s, "text", "str")
+	store.PostStateValue(&s, true, "flag")
+	store.DeleteStateJSON(&s, "a")
+
+	got := state{StateID: "room"}
+	if err := store.GetState(&got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Data["a"]; ok {
+		t.Errorf("Expected key 'a' to be removed. Got '%v'", got.Data)
+	}
+	if got.Data["str"] != "text" || got.Data["flag"] != true {
+		t.Errorf("Expected 'str' and 'flag' to be set. Got '%v'", got.Data)
+	}
+
+	obj, err := store.GetStatePath(&got, []string{"obj"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.(map[string]interface{})["x"] != 1.0 {
+		t.Errorf("Expected 'obj' to be returned. Got '%v'", obj)
+	}
+
+	if err := store.PostStatePath(&s, "postStatePath", []string{"obj", "y", "z"}, 1.0); err != errPathNotFound {
+		t.Errorf("Expected errPathNotFound for a missing intermediate key. Got '%v'", err)
+	}
+	if err := store.PostStatePath(&s, "postStatePath", []string{"obj", "y"}, []interface{}{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	store.PostStatePath(&s, "postStatePath", []string{"obj", "y", "1"}, "b")
+	store.DeleteStatePath(&s, "deleteStatePath", []string{"obj", "x"})
+	obj, _ = store.GetStatePath(&got, []string{"obj"})
+	if !reflect.DeepEqual(obj, map[string]interface{}{"y": []interface{}{"a", "b"}}) {
+		t.Errorf("Expected the nested writes to apply. Got '%v'", obj)
+	}
+	if _, err := store.GetStatePath(&got, []string{"obj", "x"}); err != errPathNotFound {
+		t.Errorf("Expected errPathNotFound for a removed key. Got '%v'", err)
+	}
+
+	found, err := store.FindStates(search{Contains: []interface{}{map[string]interface{}{"name": "main"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].StateID != "room" {
+		t.Errorf("Expected to find state 'room'. Got '%v'", found)
+	}
+
+	tagged, _ := store.GetStateByTag("galaxy")
+	if _, ok := tagged["room"]; !ok {
+		t.Errorf("Expected state 'room' under tag 'galaxy'. Got '%v'", tagged)
+	}
+
+	err = store.ModifyState(&s, "patchState", func(data map[string]interface{}) (map[string]interface{}, error) {
+		data["str"] = "changed"
+		return data, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.GetState(&got)
+	if got.Data["str"] != "changed" || got.Rev != s.Rev {
+		t.Errorf("Expected the modified state at revision %d. Got '%v' at %d", s.Rev, got.Data, got.Rev)
+	}
+
+	if n, err := store.IncrStatePath(&s, "incrStatePath", []string{"obj", "n"}, 2, nil, nil); err != nil || n != 2 {
+		t.Errorf("Expected the counter to be 2. Got %v '%v'", n, err)
+	}
+	if _, err := store.IncrStatePath(&s, "incrStatePath", []string{"str"}, 1, nil, nil); err != errNotNumber {
+		t.Errorf("Expected errNotNumber. Got '%v'", err)
+	}
+
+	missing := state{StateID: "missing"}
+	if err := store.ModifyState(&missing, "patchState", nil); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing state. Got '%v'", err)
+	}
+
+	store.DeleteState(&s)
+	if err := store.GetState(&got); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows. Got '%v'", err)
+	}
+}
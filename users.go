@@ -0,0 +1,817 @@
+// users.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// usersSQL holds the statements of the per-user storage of a SQL store. The
+// header statements take the state id as their first argument.
+type usersSQL struct {
+	schema string
+	// exists tells whether state_user exists, without creating it.
+	exists string
+	// lockWrite is taken by every writer of a user and lockAll excludes
+	// them, lockUser serializes the writers of one user and lockHeader
+	// the writers of the header. They are empty when the database
+	// serializes the writers anyway.
+	lockWrite  string
+	lockAll    string
+	lockUser   string
+	lockHeader string
+	header     string
+	// create inserts a missing header, its revision continuing the history.
+	create string
+	// bump takes the next revision of the header and returns it.
+	bump   string
+	drop   string
+	all    string
+	user   string
+	room   string
+	put    string
+	remove string
+	clear  string
+	// query runs a JSONPath query on the users, empty when the database has
+	// no jsonb_path_query.
+	query   string
+	history historySQL
+}
+
+// usersStore keeps the galaxy users state as one record per user, indexed
+// by room, so that a user joining or leaving writes its own record and not
+// the whole document. The state row of the users remains, with empty data,
+// for the tag, the creation time and the revision, which every write bumps
+// as its last step. The other states are left to the wrapped store.
+type usersStore struct {
+	Store
+	db *sql.DB
+	q  usersSQL
+}
+
+// newUsersStore creates the users table and moves the entries of an
+// existing users state to it.
+func newUsersStore(store Store, db *sql.DB, q usersSQL) (*usersStore, error) {
+	if _, err := db.Exec(q.schema); err != nil {
+		return nil, err
+	}
+
+	u := &usersStore{Store: store, db: db, q: q}
+	if err := u.migrate(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (u *usersStore) migrate() error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := execIf(tx, u.q.lockAll); err != nil {
+		return err
+	}
+
+	var obj []byte
+	var rev int
+	err = tx.QueryRow(u.q.history.current, usersStateID).Scan(&obj, &rev)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(obj, &data); err != nil || len(data) == 0 {
+		return err
+	}
+	for id, v := range data {
+		if err := u.put(tx, id, v); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(u.q.history.update, usersStateID, "{}", rev); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+var errOrphanUsers = errors.New("state_user has users but there is no users state")
+
+// restoreUsers is the reverse of migrate, run when the users table is off:
+// it moves the users of state_user back to the data of the users state,
+// which would read empty otherwise.
+func restoreUsers(db *sql.DB, q usersSQL) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(q.exists).Scan(&exists); err != nil || !exists {
+		return err
+	}
+	if err := execIf(tx, q.lockAll); err != nil {
+		return err
+	}
+	if err := execIf(tx, q.history.lock, usersStateID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(q.all)
+	if err != nil {
+		return err
+	}
+	users, err := scanUsers(rows)
+	if err != nil || len(users) == 0 {
+		return err
+	}
+
+	var obj []byte
+	var rev int
+	err = tx.QueryRow(q.history.current, usersStateID).Scan(&obj, &rev)
+	if err == sql.ErrNoRows {
+		return errOrphanUsers
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]interface{})
+	json.Unmarshal(obj, &data)
+	for id, v := range users {
+		data[id] = v
+	}
+	b, _ := json.Marshal(data)
+	if _, err := tx.Exec(q.history.update, usersStateID, string(b), rev); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(q.clear); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func execIf(tx *sql.Tx, query string, args ...interface{}) error {
+	if query == "" {
+		return nil
+	}
+
+	_, err := tx.Exec(query, args...)
+
+	return err
+}
+
+func (u *usersStore) put(tx *sql.Tx, id string, v interface{}) error {
+	b, _ := json.Marshal(v)
+	_, err := tx.Exec(u.q.put, id, string(b))
+
+	return err
+}
+
+func scanUsers(rows *sql.Rows) (map[string]interface{}, error) {
+	defer rows.Close()
+
+	users := make(map[string]interface{})
+	for rows.Next() {
+		var id string
+		var obj []byte
+		var v interface{}
+		if err := rows.Scan(&id, &obj); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(obj, &v)
+		users[id] = v
+	}
+
+	return users, rows.Err()
+}
+
+// snapshot begins a read of the header of the users state and of the
+// users, so that the revision matches the data.
+func (u *usersStore) snapshot(s *state) (*sql.Tx, error) {
+	tx, err := u.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(u.q.header, usersStateID).Scan(&s.ID, &s.Tag, &s.Rev, &s.Created, &s.Updated)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// load reads the users state from one snapshot.
+func (u *usersStore) load(s *state) error {
+	tx, err := u.snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	rows, err := tx.Query(u.q.all)
+	if err != nil {
+		return err
+	}
+	s.StateID = usersStateID
+	if s.Data, err = scanUsers(rows); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (u *usersStore) GetStates() ([]state, error) {
+	states, err := u.Store.GetStates()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range states {
+		if states[i].StateID == usersStateID {
+			if err := u.load(&states[i]); err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+	}
+
+	return states, nil
+}
+
+func (u *usersStore) GetStateByTag(tag string) (map[string]interface{}, error) {
+	states, err := u.Store.GetStateByTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := states[usersStateID]; ok {
+		var s state
+		if err := u.load(&s); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		states[usersStateID] = s.Data
+	}
+
+	return states, nil
+}
+
+func (u *usersStore) FindStates(q search) ([]state, error) {
+	states, err := u.Store.FindStates(q)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []state{}
+	for _, s := range states {
+		if s.StateID != usersStateID {
+			found = append(found, s)
+		}
+	}
+
+	s, err := u.find(q)
+	if err != nil || s == nil {
+		return found, err
+	}
+
+	i := sort.Search(len(found), func(i int) bool { return found[i].ID > s.ID })
+	found = append(found, state{})
+	copy(found[i+1:], found[i:])
+	found[i] = *s
+
+	return found, nil
+}
+
+// find reads the users state if it matches q. The tag of the header and
+// the users the documents of q name are checked before all the users are
+// read.
+func (u *usersStore) find(q search) (*state, error) {
+	s := state{StateID: usersStateID}
+	tx, err := u.snapshot(&s)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if q.Tag != "" && q.Tag != s.Tag {
+		return nil, nil
+	}
+
+	s.Data = make(map[string]interface{})
+	for _, c := range q.Contains {
+		doc, ok := c.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		for id := range doc {
+			if _, ok := s.Data[id]; ok {
+				continue
+			}
+			var obj []byte
+			err := tx.QueryRow(u.q.user, id).Scan(&obj)
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			var v interface{}
+			json.Unmarshal(obj, &v)
+			s.Data[id] = v
+		}
+	}
+	if !q.matches(s) {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(u.q.all)
+	if err != nil {
+		return nil, err
+	}
+	if s.Data, err = scanUsers(rows); err != nil {
+		return nil, err
+	}
+
+	return &s, tx.Commit()
+}
+
+func (u *usersStore) GetState(s *state) error {
+	if s.StateID != usersStateID {
+		return u.Store.GetState(s)
+	}
+
+	return u.load(s)
+}
+
+func (u *usersStore) GetStatePath(s *state, path []string) (interface{}, error) {
+	if s.StateID != usersStateID {
+		return u.Store.GetStatePath(s, path)
+	}
+
+	tx, err := u.snapshot(s)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var obj []byte
+	err = tx.QueryRow(u.q.user, path[0]).Scan(&obj)
+	if err == sql.ErrNoRows {
+		return nil, errPathNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	json.Unmarshal(obj, &v)
+
+	return pathGet(map[string]interface{}{path[0]: v}, path)
+}
+
+// writeAll replaces all the users with the result of fn, which gets nil
+// when the state does not exist and returns nil to delete it.
+func (u *usersStore) writeAll(s *state, op string, fn modifier) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := execIf(tx, u.q.lockAll); err != nil {
+		return err
+	}
+	if err := execIf(tx, u.q.lockHeader, usersStateID); err != nil {
+		return err
+	}
+
+	var cur state
+	var old map[string]interface{}
+	err = tx.QueryRow(u.q.header, usersStateID).Scan(&cur.ID, &cur.Tag, &cur.Rev, &cur.Created, &cur.Updated)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if exists {
+		rows, err := tx.Query(u.q.all)
+		if err != nil {
+			return err
+		}
+		if old, err = scanUsers(rows); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Cond.check(exists, cur.Rev); err != nil {
+		return err
+	}
+
+	data, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if data == nil && !exists {
+		return nil
+	}
+
+	if !exists {
+		if _, err := tx.Exec(u.q.create, usersStateID, s.Tag); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(u.q.header, usersStateID).Scan(&cur.ID, &cur.Tag, &cur.Rev, &cur.Created, &cur.Updated); err != nil {
+			return err
+		}
+	}
+
+	var rev int
+	if err := tx.QueryRow(u.q.bump, usersStateID).Scan(&rev); err != nil {
+		return err
+	}
+
+	if data == nil {
+		if _, err := tx.Exec(u.q.clear); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(u.q.drop, usersStateID); err != nil {
+			return err
+		}
+	} else {
+		for id := range old {
+			if _, ok := data[id]; !ok {
+				if _, err := tx.Exec(u.q.remove, id); err != nil {
+					return err
+				}
+			}
+		}
+		for id, v := range data {
+			if ov, ok := old[id]; !ok || !reflect.DeepEqual(ov, v) {
+				if err := u.put(tx, id, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	var oldValue, newValue json.RawMessage
+	if exists {
+		oldValue, _ = json.Marshal(old)
+	}
+	if data != nil {
+		newValue, _ = json.Marshal(data)
+	}
+	if !s.NoHistory {
+		if _, err := tx.Exec(u.q.history.insert, usersStateID, rev, op, "", nullJSON(oldValue), nullJSON(newValue), s.Client); err != nil {
+			return err
+		}
+	}
+	if err := notifyWrite(tx, u.q.history, change{Op: op, Tag: cur.Tag, StateID: usersStateID, Value: newValue, Rev: rev}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.ID = cur.ID
+	s.Rev = rev
+	s.Data = data
+
+	return nil
+}
+
+// writeUser replaces the entry of one user with the result of fn on a
+// document holding only that entry, and records the change under key.
+func (u *usersStore) writeUser(s *state, op, key, id string, fn modifier) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := execIf(tx, u.q.lockWrite); err != nil {
+		return err
+	}
+	if err := execIf(tx, u.q.lockUser, id); err != nil {
+		return err
+	}
+	// The header is locked early only to check a precondition, otherwise
+	// just for the bump of the revision.
+	if s.Cond != nil {
+		if err := execIf(tx, u.q.lockHeader, usersStateID); err != nil {
+			return err
+		}
+	}
+
+	var cur state
+	err = tx.QueryRow(u.q.header, usersStateID).Scan(&cur.ID, &cur.Tag, &cur.Rev, &cur.Created, &cur.Updated)
+	if err != nil {
+		return err
+	}
+	if err := s.Cond.check(true, cur.Rev); err != nil {
+		return err
+	}
+
+	doc := make(map[string]interface{})
+	var obj []byte
+	err = tx.QueryRow(u.q.user, id).Scan(&obj)
+	if err == nil {
+		var v interface{}
+		json.Unmarshal(obj, &v)
+		doc[id] = v
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	oldDoc, _ := json.Marshal(doc)
+
+	doc, err = fn(doc)
+	if err != nil {
+		return err
+	}
+
+	if v, ok := doc[id]; ok {
+		err = u.put(tx, id, v)
+	} else if obj != nil {
+		_, err = tx.Exec(u.q.remove, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	var rev int
+	if err := tx.QueryRow(u.q.bump, usersStateID).Scan(&rev); err != nil {
+		return err
+	}
+
+	newDoc, _ := json.Marshal(doc)
+	if !s.NoHistory {
+		if _, err := tx.Exec(u.q.history.insert, usersStateID, rev, op, key, nullJSON(historyValue(oldDoc, key)), nullJSON(historyValue(newDoc, key)), s.Client); err != nil {
+			return err
+		}
+	}
+	if err := notifyWrite(tx, u.q.history, change{Op: op, Tag: cur.Tag, StateID: usersStateID, Key: key, Value: historyValue(newDoc, key), Rev: rev}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.Rev = rev
+
+	return nil
+}
+
+func (u *usersStore) PostState(s *state) error {
+	if s.StateID != usersStateID {
+		return u.Store.PostState(s)
+	}
+
+	return u.writeAll(s, "postState", func(data map[string]interface{}) (map[string]interface{}, error) {
+		return s.Data, nil
+	})
+}
+
+func (u *usersStore) UpdateState(s *state) error {
+	if s.StateID != usersStateID {
+		return u.Store.UpdateState(s)
+	}
+
+	return u.writeAll(s, "updateState", func(data map[string]interface{}) (map[string]interface{}, error) {
+		if data == nil {
+			return nil, nil
+		}
+		return s.Data, nil
+	})
+}
+
+func (u *usersStore) ModifyState(s *state, op string, fn modifier) error {
+	if s.StateID != usersStateID {
+		return u.Store.ModifyState(s, op, fn)
+	}
+
+	return u.writeAll(s, op, func(data map[string]interface{}) (map[string]interface{}, error) {
+		if data == nil {
+			return nil, sql.ErrNoRows
+		}
+		data, err := fn(data)
+		if data == nil && err == nil {
+			data = make(map[string]interface{})
+		}
+		return data, err
+	})
+}
+
+func (u *usersStore) DeleteState(s *state) error {
+	if s.StateID != usersStateID {
+		return u.Store.DeleteState(s)
+	}
+
+	return u.writeAll(s, "deleteState", func(data map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	})
+}
+
+// setUser is the key operations of the users state. Like on the other
+// states, they do nothing while the state does not exist.
+func (u *usersStore) setUser(s *state, op, key string, value interface{}, remove bool) error {
+	err := u.writeUser(s, op, key, key, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		if remove {
+			delete(doc, key)
+		} else {
+			doc[key] = value
+		}
+		return doc, nil
+	})
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	return err
+}
+
+func (u *usersStore) PostStateValue(s *state, value interface{}, key string) error {
+	if s.StateID != usersStateID {
+		return u.Store.PostStateValue(s, value, key)
+	}
+
+	return u.setUser(s, "postStateValue", key, value, false)
+}
+
+func (u *usersStore) PostStateJSON(s *state, value interface{}, key string) error {
+	if s.StateID != usersStateID {
+		return u.Store.PostStateJSON(s, value, key)
+	}
+
+	return u.setUser(s, "postStateJSON", key, value, false)
+}
+
+func (u *usersStore) DeleteStateJSON(s *state, key string) error {
+	if s.StateID != usersStateID {
+		return u.Store.DeleteStateJSON(s, key)
+	}
+
+	return u.setUser(s, "deleteStateJSON", key, nil, true)
+}
+
+func (u *usersStore) PostStatePath(s *state, op string, path []string, value interface{}) error {
+	if s.StateID != usersStateID {
+		return u.Store.PostStatePath(s, op, path, value)
+	}
+
+	return u.writeUser(s, op, pathKey(path), path[0], func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return pathSet(doc, path, value)
+	})
+}
+
+func (u *usersStore) DeleteStatePath(s *state, op string, path []string) error {
+	if s.StateID != usersStateID {
+		return u.Store.DeleteStatePath(s, op, path)
+	}
+
+	return u.writeUser(s, op, pathKey(path), path[0], func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return pathDelete(doc, path)
+	})
+}
+
+func (u *usersStore) IncrStatePath(s *state, op string, path []string, by float64, min, max *float64) (float64, error) {
+	if s.StateID != usersStateID {
+		return u.Store.IncrStatePath(s, op, path, by, min, max)
+	}
+
+	var n float64
+	err := u.writeUser(s, op, pathKey(path), path[0], func(doc map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		doc, n, err = pathIncr(doc, path, by, min, max)
+		return doc, err
+	})
+
+	return n, err
+}
+
+func (u *usersStore) ArrayStatePath(s *state, op string, path []string, a arrayOp) ([]interface{}, error) {
+	if s.StateID != usersStateID {
+		return u.Store.ArrayStatePath(s, op, path, a)
+	}
+
+	var arr []interface{}
+	err := u.writeUser(s, op, pathKey(path), path[0], func(doc map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		doc, arr, err = applyArrayOp(doc, path, a)
+		return doc, err
+	})
+
+	return arr, err
+}
+
+func (u *usersStore) queryUsers(s *state, q jsonQuery) ([]interface{}, error) {
+	if u.q.query == "" {
+		return nil, errQueryUnsupported
+	}
+
+	err := u.db.QueryRow(u.q.header, usersStateID).Scan(&s.ID, &s.Tag, &s.Rev, &s.Created, &s.Updated)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, _ := json.Marshal(q.Vars)
+	var obj []byte
+	if err := u.db.QueryRow(u.q.query, q.Path, string(vars)).Scan(&obj); err != nil {
+		return nil, jsonPathError(err)
+	}
+
+	items := []interface{}{}
+	err = json.Unmarshal(obj, &items)
+
+	return items, err
+}
+
+func (u *usersStore) QueryState(s *state, q jsonQuery) ([]interface{}, error) {
+	if s.StateID != usersStateID {
+		return u.Store.QueryState(s, q)
+	}
+
+	return u.queryUsers(s, q)
+}
+
+func (u *usersStore) QueryStates(tag string, q jsonQuery) (map[string][]interface{}, error) {
+	found, err := u.Store.QueryStates(tag, q)
+	if err != nil {
+		return nil, err
+	}
+	delete(found, usersStateID)
+
+	var s state
+	items, err := u.queryUsers(&s, q)
+	if err == sql.ErrNoRows || (err == nil && s.Tag != tag) {
+		return found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > 0 {
+		found[usersStateID] = items
+	}
+
+	return found, nil
+}
+
+func (u *usersStore) GetRooms() ([]room, error) {
+	var s state
+	err := u.load(&s)
+	if err == sql.ErrNoRows {
+		return []room{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregateRooms(galaxyUsers(s.Data)), nil
+}
+
+// GetRoom reads only the users of the room, through the room index.
+func (u *usersStore) GetRoom(r *room, id int) error {
+	rows, err := u.db.Query(u.q.room, strconv.Itoa(id))
+	if err != nil {
+		return err
+	}
+
+	users, err := scanUsers(rows)
+	if err != nil {
+		return err
+	}
+	found, ok := findRoom(galaxyUsers(users), id)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*r = found
+
+	return nil
+}
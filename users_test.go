@@ -0,0 +1,236 @@
+// users_test.go
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUsersStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsondb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", sqliteDSN(filepath.Join(dir, "state.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := newSQLiteStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	s := state{StateID: usersStateID, Tag: "galaxy", Data: map[string]interface{}{
+		"u1": map[string]interface{}{"room": 1.0},
+		"u2": map[string]interface{}{"room": 2.0},
+	}}
+	inner.PostState(&s)
+	hall := state{StateID: "room", Tag: "galaxy", Data: map[string]interface{}{"name": "main"}}
+	inner.PostState(&hall)
+
+	u, err := newUsersStore(inner, db, sqliteUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := state{StateID: usersStateID}
+	inner.GetState(&header)
+	if len(header.Data) != 0 {
+		t.Errorf("Expected the users to move out of the state. Got '%v'", header.Data)
+	}
+
+	s = state{StateID: usersStateID}
+	if err := u.GetState(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Rev != 1 || len(s.Data) != 2 || s.Tag != "galaxy" {
+		t.Errorf("Expected the migrated users at revision 1. Got '%+v'", s)
+	}
+
+	u.PostStateJSON(&s, map[string]interface{}{"room": 2.0, "name": "c"}, "u3")
+	u.DeleteStateJSON(&s, "u1")
+	u.PostStatePath(&s, "postStatePath", []string{"u2", "name"}, "b")
+	if n, err := u.IncrStatePath(&s, "incrStatePath", []string{"u2", "score"}, 2, nil, nil); err != nil || n != 2 {
+		t.Errorf("Expected the score 2. Got '%v' '%v'", n, err)
+	}
+	if arr, err := u.ArrayStatePath(&s, "arrayStatePath", []string{"u2", "tags"}, arrayOp{Op: "append", Value: "x"}); err != nil || len(arr) != 1 {
+		t.Errorf("Expected one tag. Got '%v' '%v'", arr, err)
+	}
+	if err := u.PostStatePath(&s, "postStatePath", []string{"u9", "name"}, "z"); err != errPathNotFound {
+		t.Errorf("Expected errPathNotFound below a missing user. Got '%v'", err)
+	}
+	if s.Rev != 6 {
+		t.Errorf("Expected revision 6. Got '%v'", s.Rev)
+	}
+
+	want := map[string]interface{}{
+		"u2": map[string]interface{}{"room": 2.0, "name": "b", "score": 2.0, "tags": []interface{}{"x"}},
+		"u3": map[string]interface{}{"room": 2.0, "name": "c"},
+	}
+	s = state{StateID: usersStateID}
+	u.GetState(&s)
+	if !reflect.DeepEqual(s.Data, want) {
+		t.Errorf("Expected '%v'. Got '%v'", want, s.Data)
+	}
+	if v, err := u.GetStatePath(&s, []string{"u2", "name"}); err != nil || v != "b" {
+		t.Errorf("Expected the name of u2. Got '%v' '%v'", v, err)
+	}
+
+	var r room
+	if err := u.GetRoom(&r, 2); err != nil || r.NumUsers != 2 {
+		t.Errorf("Expected room 2 with 2 users. Got '%+v' '%v'", r, err)
+	}
+	if err := u.GetRoom(&r, 1); err != sql.ErrNoRows {
+		t.Errorf("Expected room 1 to be gone. Got '%v'", err)
+	}
+
+	tagged, _ := u.GetStateByTag("galaxy")
+	if !reflect.DeepEqual(tagged[usersStateID], want) || tagged["room"] == nil {
+		t.Errorf("Expected the users and the room under the tag. Got '%v'", tagged)
+	}
+	found, _ := u.FindStates(search{Contains: []interface{}{condition([]string{"u3", "name"}, "c")}})
+	if len(found) != 1 || found[0].StateID != usersStateID || !reflect.DeepEqual(found[0].Data, want) {
+		t.Errorf("Expected to find all the users. Got '%v'", found)
+	}
+	for _, q := range []search{
+		{Tag: "other"},
+		{Contains: []interface{}{condition([]string{"u9", "name"}, "c")}},
+		{Contains: []interface{}{condition([]string{"u3", "name"}, "d")}},
+		{Contains: []interface{}{[]interface{}{}}},
+	} {
+		found, err := u.FindStates(q)
+		if err != nil {
+			t.Errorf("%v: %v", q, err)
+		}
+		for _, s := range found {
+			if s.StateID == usersStateID {
+				t.Errorf("%v: expected the users not to match. Got '%v'", q, s)
+			}
+		}
+	}
+	if _, err := u.QueryState(&state{StateID: usersStateID}, jsonQuery{Path: "$.*"}); err != errQueryUnsupported {
+		t.Errorf("Expected errQueryUnsupported without jsonb_path_query. Got '%v'", err)
+	}
+
+	history, _ := u.GetHistory(usersStateID, 1, 0)
+	if len(history) != 5 || history[0].Key != "u3" || history[1].Op != "deleteStateJSON" || string(history[1].OldValue) != `{"room":1}` {
+		t.Errorf("Unexpected history '%+v'", history)
+	}
+	old := state{StateID: usersStateID}
+	if err := stateAt(u, &old, 2); err != nil || len(old.Data) != 3 {
+		t.Errorf("Expected 3 users at revision 2. Got '%v' '%v'", old.Data, err)
+	}
+
+	// Writes without history still take a revision, for the users and for
+	// the other states.
+	for _, id := range []string{usersStateID, "room"} {
+		history, _ := u.GetHistory(id, 0, 0)
+		quiet := state{StateID: id, NoHistory: true}
+		path := []string{"u3", "last_seen"}
+		if id == "room" {
+			path = []string{"last_seen"}
+		}
+		if err := u.PostStatePath(&quiet, "heartbeat", path, 1.0); err != nil || quiet.Rev == 0 {
+			t.Errorf("%s: expected a revision. Got '%v' '%v'", id, quiet.Rev, err)
+		}
+		if h, _ := u.GetHistory(id, 0, 0); len(h) != len(history) {
+			t.Errorf("%s: expected no history entry. Got '%v'", id, h)
+		}
+	}
+
+	s.Cond = &precondition{Match: []int{1}}
+	if err := u.PostStateJSON(&s, "x", "u4"); err != errPreconditionFailed {
+		t.Errorf("Expected errPreconditionFailed. Got '%v'", err)
+	}
+	s.Cond = nil
+
+	if err := u.DeleteState(&s); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.GetState(&state{StateID: usersStateID}); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows. Got '%v'", err)
+	}
+	missing := state{StateID: usersStateID}
+	if err := u.PostStateJSON(&missing, "x", "u4"); err != nil || missing.Rev != 0 {
+		t.Errorf("Expected a key write on a missing state to do nothing. Got '%v' '%v'", missing.Rev, err)
+	}
+	s = state{StateID: usersStateID, Tag: "galaxy", Data: map[string]interface{}{"u5": map[string]interface{}{"room": 5.0}}}
+	if err := u.PostState(&s); err != nil || s.Rev != 9 {
+		t.Errorf("Expected the revisions to continue. Got '%v' '%v'", s.Rev, err)
+	}
+
+	hall = state{StateID: "room"}
+	if err := u.GetState(&hall); err != nil || hall.Data["name"] != "main" {
+		t.Errorf("Expected the other states to be left alone. Got '%v' '%v'", hall.Data, err)
+	}
+}
+
+func TestRestoreUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsondb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", sqliteDSN(filepath.Join(dir, "state.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := newSQLiteStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	// Without state_user there is nothing to restore.
+	if err := restoreUsers(db, sqliteUsers); err != nil {
+		t.Fatal(err)
+	}
+
+	s := state{StateID: usersStateID, Tag: "galaxy", Data: map[string]interface{}{"u1": map[string]interface{}{"room": 1.0}}}
+	inner.PostState(&s)
+	u, err := newUsersStore(inner, db, sqliteUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.PostStateJSON(&s, map[string]interface{}{"room": 2.0}, "u2")
+	want := state{StateID: usersStateID}
+	u.GetState(&want)
+
+	if err := restoreUsers(db, sqliteUsers); err != nil {
+		t.Fatal(err)
+	}
+	got := state{StateID: usersStateID}
+	inner.GetState(&got)
+	if got.Rev != want.Rev || !reflect.DeepEqual(got.Data, want.Data) {
+		t.Errorf("Expected the users back in the state at revision %d. Got '%+v'", want.Rev, got)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM state_user").Scan(&n)
+	if n != 0 {
+		t.Errorf("Expected state_user to be emptied. Got %d rows", n)
+	}
+
+	// Turning the table on again moves them back.
+	if u, err = newUsersStore(inner, db, sqliteUsers); err != nil {
+		t.Fatal(err)
+	}
+	got = state{StateID: usersStateID}
+	u.GetState(&got)
+	if got.Rev != want.Rev || !reflect.DeepEqual(got.Data, want.Data) {
+		t.Errorf("Expected the same users from the table. Got '%+v'", got)
+	}
+
+	inner.DeleteState(&state{StateID: usersStateID})
+	if err := restoreUsers(db, sqliteUsers); err != errOrphanUsers {
+		t.Errorf("Expected errOrphanUsers. Got '%v'", err)
+	}
+}
@@ -0,0 +1,113 @@
+// ws.go
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// checkOrigin accepts the handshakes from the configured CORS origins and
+// from clients sending no Origin, which are not browsers.
+func (a *App) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range a.config.CORS.Origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+type wsRequest struct {
+	Action string `json:"action"`
+	topic
+}
+
+// subscribeWS upgrades to a WebSocket on which the client sends
+// {"action":"subscribe","state_id":"users","key":"abc"} (or "unsubscribe")
+// messages and receives every matching change. Topics can also be given as
+// tag, id and key query parameters when connecting.
+func (a *App) subscribeWS(w http.ResponseWriter, r *http.Request) {
+	u := upgrader
+	u.CheckOrigin = a.checkOrigin
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sub := a.events.subscribe()
+	defer a.events.unsubscribe(sub)
+
+	q := r.URL.Query()
+	if t := (topic{Tag: q.Get("tag"), StateID: q.Get("id"), Key: q.Get("key")}); t != (topic{}) {
+		sub.add(t)
+	}
+
+	go func() {
+		defer a.events.unsubscribe(sub)
+
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+
+		for {
+			var req wsRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+
+			switch req.Action {
+			case "subscribe":
+				sub.add(req.topic)
+			case "unsubscribe":
+				sub.remove(req.topic)
+			default:
+				log.Printf("ws: unknown action %q", req.Action)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case c, ok := <-sub.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteJSON(c); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}